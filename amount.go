@@ -0,0 +1,47 @@
+package idx
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Amount is an amount of money in cents, or in hundredths of another currency
+// with two decimals. Using an integer avoids the rounding errors of floating
+// point numbers.
+type Amount int64
+
+// ParseAmount parses an amount in the format used by iDeal: digits, a dot and
+// exactly two decimals, for example "10.00". Signs, thousands separators and
+// decimal commas are not accepted.
+func ParseAmount(s string) (Amount, error) {
+	if len(s) < 4 || s[len(s)-3] != '.' {
+		return 0, errors.New("idx: invalid amount " + strconv.Quote(s) + ": must have a dot and two decimals, e.g. \"10.00\"")
+	}
+	digits := s[:len(s)-3] + s[len(s)-2:]
+	if len(digits) > 15 {
+		return 0, errors.New("idx: invalid amount " + strconv.Quote(s) + ": too large")
+	}
+	var amount Amount
+	for i := 0; i < len(digits); i++ {
+		c := digits[i]
+		if c < '0' || c > '9' {
+			return 0, errors.New("idx: invalid amount " + strconv.Quote(s) + ": must have a dot and two decimals, e.g. \"10.00\"")
+		}
+		amount = amount*10 + Amount(c-'0')
+	}
+	return amount, nil
+}
+
+// String formats the amount in the format used by iDeal, e.g. "10.00".
+func (a Amount) String() string {
+	sign := ""
+	if a < 0 {
+		sign = "-"
+		a = -a
+	}
+	cents := strconv.FormatInt(int64(a%100), 10)
+	if len(cents) == 1 {
+		cents = "0" + cents
+	}
+	return sign + strconv.FormatInt(int64(a/100), 10) + "." + cents
+}
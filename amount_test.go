@@ -0,0 +1,51 @@
+package idx
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	for _, tc := range []struct {
+		s      string
+		amount Amount
+		ok     bool
+	}{
+		{"1.00", 100, true},
+		{"0.01", 1, true},
+		{"10.50", 1050, true},
+		{"0010.50", 1050, true},
+		{"9999999999999.99", 999999999999999, true},
+		{"99999999999999.99", 0, false},
+		{"", 0, false},
+		{".50", 0, false},
+		{"10", 0, false},
+		{"10.5", 0, false},
+		{"10.500", 0, false},
+		{"10,50", 0, false},
+		{"-1.00", 0, false},
+		{"+1.00", 0, false},
+		{" 1.00", 0, false},
+		{"1.0a", 0, false},
+		{"1,000.00", 0, false},
+	} {
+		amount, err := ParseAmount(tc.s)
+		if (err == nil) != tc.ok || amount != tc.amount {
+			t.Errorf("ParseAmount(%q): got %d, %v", tc.s, amount, err)
+		}
+		if tc.ok && tc.s[0] != '0' && amount.String() != tc.s {
+			t.Errorf("ParseAmount(%q).String(): got %s", tc.s, amount.String())
+		}
+	}
+}
+
+func TestParsedAmount(t *testing.T) {
+	status := &IDealTransactionStatus{Amount: "12.34"}
+	if amount, err := status.ParsedAmount(); err != nil || amount != 1234 {
+		t.Errorf("expected 1234, got %d, %v", amount, err)
+	}
+	// A missing or malformed amount from the acquirer is detected.
+	for _, s := range []string{"", "12.3", "12,34"} {
+		status := &IDealTransactionStatus{Amount: s}
+		if _, err := status.ParsedAmount(); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
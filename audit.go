@@ -0,0 +1,175 @@
+package idx
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// AuditRecord combines the request parameters, the result of starting the
+// transaction and the final status of an iDeal transaction, for keeping a
+// record of the transaction in case of disputes. It can be serialized as JSON.
+type AuditRecord struct {
+	CreateDateTimestamp     string    `json:"createDateTimestamp"` // When the transaction request was created.
+	IssuerID                string    `json:"issuerID"`
+	PurchaseID              string    `json:"purchaseID"`
+	Amount                  string    `json:"amount"`
+	Currency                string    `json:"currency"`
+	Description             string    `json:"description"`
+	EntranceCode            string    `json:"entranceCode"`
+	TransactionID           string    `json:"transactionID"`
+	IssuerAuthenticationURL string    `json:"issuerAuthenticationURL"`
+	Status                  string    `json:"status,omitempty"`
+	StatusDateTimestamp     string    `json:"statusDateTimestamp,omitempty"` // When the status last changed.
+	ConsumerName            string    `json:"consumerName,omitempty"`
+	ConsumerIBAN            string    `json:"consumerIBAN,omitempty"`
+	ConsumerBIC             string    `json:"consumerBIC,omitempty"`
+	RecordedAt              time.Time `json:"recordedAt"`              // When this record was created.
+	SignedRequest           []byte    `json:"signedRequest,omitempty"` // Only present with CommonClient.KeepMessages.
+
+	// RawResponse is the signed AcquirerStatusRes with the final status, only
+	// present with CommonClient.KeepMessages. It contains the personal data
+	// of the consumer, so it is left out by MarshalRedacted and encrypted by
+	// MarshalEncrypted.
+	RawResponse []byte `json:"rawResponse,omitempty"`
+
+	rand io.Reader // CommonClient.Rand of the client of the transaction
+}
+
+// AuditRecord returns a record of this transaction and its final status. The
+// status may be nil if it isn't known (yet).
+func (t *IDealTransaction) AuditRecord(status *IDealTransactionStatus) AuditRecord {
+	record := AuditRecord{
+		CreateDateTimestamp:     optionalText(t.msg, "createDateTimestamp"),
+		IssuerID:                optionalText(t.msg, "Issuer/issuerID"),
+		PurchaseID:              optionalText(t.msg, "Transaction/purchaseID"),
+		Amount:                  optionalText(t.msg, "Transaction/amount"),
+		Currency:                optionalText(t.msg, "Transaction/currency"),
+		Description:             optionalText(t.msg, "Transaction/description"),
+		EntranceCode:            optionalText(t.msg, "Transaction/entranceCode"),
+		TransactionID:           t.transactionID,
+		IssuerAuthenticationURL: t.issuerAuthenticationURL,
+		RecordedAt:              time.Now(),
+		SignedRequest:           t.signedRequest,
+		rand:                    t.client.randReader(),
+	}
+	if status != nil {
+		record.Status = status.Status.String()
+		record.StatusDateTimestamp = status.StatusDateTimestamp
+		record.RawResponse = status.RawResponse
+		record.ConsumerName = status.ConsumerName
+		record.ConsumerIBAN = status.ConsumerIBAN
+		record.ConsumerBIC = status.ConsumerBIC
+	}
+	return record
+}
+
+// auditPII holds the personal data of an AuditRecord, which is encrypted by
+// MarshalEncrypted.
+type auditPII struct {
+	ConsumerName string `json:"consumerName,omitempty"`
+	ConsumerIBAN string `json:"consumerIBAN,omitempty"`
+	RawResponse  []byte `json:"rawResponse,omitempty"`
+}
+
+// encryptedAuditRecord is the serialization format of MarshalEncrypted.
+type encryptedAuditRecord struct {
+	AuditRecord
+	EncryptedPII []byte `json:"encryptedPII,omitempty"` // nonce followed by the AES-GCM sealed auditPII
+}
+
+// redacted returns a copy of the record without the name of the consumer and
+// the raw response, and with all but the country code and last 4 characters of
+// the IBAN masked, so that the transaction can still be matched with a bank
+// statement.
+func (r AuditRecord) redacted() AuditRecord {
+	r.ConsumerName = ""
+	r.RawResponse = nil
+	if len(r.ConsumerIBAN) > 6 {
+		r.ConsumerIBAN = r.ConsumerIBAN[:2] + strings.Repeat("*", len(r.ConsumerIBAN)-6) + r.ConsumerIBAN[len(r.ConsumerIBAN)-4:]
+	} else {
+		r.ConsumerIBAN = ""
+	}
+	return r
+}
+
+// MarshalRedacted serializes the record as JSON without personal data of the
+// consumer, for archives that must not contain it. The consumer name and the
+// raw response are left out and the IBAN is masked except for the country code
+// and the last 4 characters.
+func (r AuditRecord) MarshalRedacted() ([]byte, error) {
+	return json.Marshal(r.redacted())
+}
+
+// MarshalEncrypted serializes the record like MarshalRedacted, but adds the
+// personal data encrypted with AES-GCM using the given key (16, 24 or 32
+// bytes), so it is only available to those with the key. Use
+// UnmarshalEncryptedAuditRecord to get the full record back. The encrypted data
+// is bound to the TransactionID of the record, so it can't be moved to the
+// record of another transaction without being detected. The nonce is read from
+// CommonClient.Rand of the client of the transaction, or from crypto/rand for a
+// record that wasn't created by IDealTransaction.AuditRecord.
+func (r AuditRecord) MarshalEncrypted(key []byte) ([]byte, error) {
+	gcm, err := newAuditGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	pii, err := json.Marshal(auditPII{r.ConsumerName, r.ConsumerIBAN, r.RawResponse})
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	random := r.rand
+	if random == nil {
+		random = rand.Reader
+	}
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(encryptedAuditRecord{
+		AuditRecord:  r.redacted(),
+		EncryptedPII: gcm.Seal(nonce, nonce, pii, []byte(r.TransactionID)),
+	})
+}
+
+// UnmarshalEncryptedAuditRecord parses a record serialized by MarshalEncrypted
+// and decrypts the personal data with the given key.
+func UnmarshalEncryptedAuditRecord(data, key []byte) (AuditRecord, error) {
+	var record encryptedAuditRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return AuditRecord{}, err
+	}
+	gcm, err := newAuditGCM(key)
+	if err != nil {
+		return AuditRecord{}, err
+	}
+	if len(record.EncryptedPII) < gcm.NonceSize() {
+		return AuditRecord{}, errors.New("idx: audit record has no encrypted personal data")
+	}
+	nonce, ciphertext := record.EncryptedPII[:gcm.NonceSize()], record.EncryptedPII[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(record.TransactionID))
+	if err != nil {
+		return AuditRecord{}, errors.New("idx: could not decrypt audit record: " + err.Error())
+	}
+	var pii auditPII
+	if err := json.Unmarshal(plaintext, &pii); err != nil {
+		return AuditRecord{}, err
+	}
+	record.AuditRecord.ConsumerName = pii.ConsumerName
+	record.AuditRecord.ConsumerIBAN = pii.ConsumerIBAN
+	record.AuditRecord.RawResponse = pii.RawResponse
+	return record.AuditRecord, nil
+}
+
+func newAuditGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
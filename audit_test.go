@@ -0,0 +1,89 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+var testAuditKey = bytes.Repeat([]byte{1}, 32)
+
+func TestMarshalEncrypted(t *testing.T) {
+	record := AuditRecord{
+		TransactionID: "0030000123456789",
+		ConsumerName:  "J. Jansen",
+		ConsumerIBAN:  "NL44RABO0123456789",
+	}
+	data, err := record.MarshalEncrypted(testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("Jansen")) || bytes.Contains(data, []byte("RABO0123")) {
+		t.Errorf("personal data is not encrypted: %s", data)
+	}
+	decrypted, err := UnmarshalEncryptedAuditRecord(data, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.ConsumerName != record.ConsumerName || decrypted.ConsumerIBAN != record.ConsumerIBAN {
+		t.Errorf("unexpected decrypted record: %+v", decrypted)
+	}
+
+	// The encrypted personal data can't be moved to another record.
+	other, err := AuditRecord{TransactionID: "0030000987654321"}.MarshalEncrypted(testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted, otherEncrypted map[string]json.RawMessage
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(other, &otherEncrypted); err != nil {
+		t.Fatal(err)
+	}
+	otherEncrypted["encryptedPII"] = encrypted["encryptedPII"]
+	moved, err := json.Marshal(otherEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnmarshalEncryptedAuditRecord(moved, testAuditKey); err == nil {
+		t.Error("expected an error for personal data of another record")
+	}
+}
+
+func TestAuditRecordStatus(t *testing.T) {
+	c := &IDealClient{CommonClient: newTestClient("https://example.com/ideal")}
+	c.KeepMessages = true
+	status, err := parseTestIDealStatus(t, c, testIDealStatusRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction := c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode")
+	record := transaction.AuditRecord(status)
+	if record.StatusDateTimestamp != "2017-01-02T15:04:00.000Z" {
+		t.Errorf("unexpected StatusDateTimestamp: %q", record.StatusDateTimestamp)
+	}
+	if string(record.RawResponse) != testIDealStatusRes {
+		t.Error("expected the raw response in the record")
+	}
+
+	// The raw response contains personal data.
+	redacted, err := record.MarshalRedacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(redacted, []byte("rawResponse")) || !bytes.Contains(redacted, []byte("2017-01-02T15:04:00.000Z")) {
+		t.Errorf("unexpected redacted record: %s", redacted)
+	}
+	encrypted, err := record.MarshalEncrypted(testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := UnmarshalEncryptedAuditRecord(encrypted, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.RawResponse, record.RawResponse) {
+		t.Error("expected the raw response in the decrypted record")
+	}
+}
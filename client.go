@@ -12,22 +12,32 @@
 // library, as banks will often require you to follow certain practices! For
 // example, every transaction *must* be closed, even if it is not successful (or
 // if the consumer closes the web browser during the iDeal/iDIN transaction).
+//
+// The test environments of the acquirers use exactly the same messages as
+// production, so there is no separate sandbox mode: switching environments is
+// done by changing BaseURL, AcquirerCert and (if your bank uses a different
+// one for testing) MerchantID.
 package idx
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/hex"
 	"encoding/xml"
 	"errors"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/beevik/etree"
-	"github.com/russellhaering/goxmldsig"
 )
 
 type TransactionStatus int
@@ -67,6 +77,8 @@ type AcquirerError struct {
 	ErrorMessage    string // Short human-readable error message.
 	ErrorDetail     string // Longer human-readable error message, e.g. the origin of the error.
 	ConsumerMessage string // The message to display on your website to the consumer.
+
+	statusConsumed bool // error code is one of IDINClient.StatusConsumedCodes
 }
 
 // Error returns a string with the error code, error message and error detail
@@ -78,6 +90,19 @@ func (e AcquirerError) Error() string {
 	return "idx: " + e.ErrorCode + ": " + e.ErrorMessage + " (" + e.ErrorDetail + ")"
 }
 
+// Is reports whether this error is classified as target, to be used with
+// errors.Is. It matches ErrClockSkew and ErrStatusAlreadyConsumed.
+func (e AcquirerError) Is(target error) bool {
+	switch target {
+	case ErrClockSkew:
+		return e.ErrorCode == errorCodeInvalidDateTime
+	case ErrStatusAlreadyConsumed:
+		return e.statusConsumed
+	default:
+		return false
+	}
+}
+
 // A Client implements common functionality between the iDeal and iDIN
 // protocols.
 type Client interface {
@@ -88,111 +113,875 @@ type Client interface {
 type CommonClient struct {
 	BaseURL      string            // The API endpoint to use, as provided by your bank.
 	MerchantID   string            // Merchant ID, as provided by your bank.
-	SubID        string            // "0" if you don't use sub IDs.
+	SubID        string            // "0" (or empty) if you don't use sub IDs.
 	ReturnURL    string            // The URL to return to after the iDeal/iDIN transaction is complete.
 	Certificate  tls.Certificate   // Your certificate, with which to sign outgoing messages.
 	AcquirerCert *x509.Certificate // The certificate of the bank, with which to verify incoming messages.
+
+	// RootCAs is used to verify the TLS certificate of the BaseURL endpoint,
+	// for acquirers that use a private CA for their API. When nil, the system
+	// roots are used. Note that this is only about the HTTPS connection: the
+	// messages themselves are always verified against AcquirerCert.
+	RootCAs *x509.CertPool
+
+	// HTTPClient, when set, is used for requests to the acquirer instead of
+	// the built-in client, e.g. to use a proxy, a custom transport or a
+	// connection pool shared with the rest of the application. RootCAs is
+	// ignored when it is set: configure the transport of this client instead.
+	HTTPClient *http.Client
+
+	// Timeout, when non-zero, limits the time of each request to the acquirer,
+	// including reading the response. It is ignored when the context passed to
+	// a *Context method already has a deadline, so that there are never two
+	// competing timeouts: the deadline of the context takes precedence. A
+	// timeout of HTTPClient does still apply. Either way, a request that times
+	// out returns an error matching ErrTimeout.
+	Timeout time.Duration
+
+	// NormalizeWhitespace trims and collapses whitespace in returned consumer
+	// names and addresses. Note that this alters the value as it was sent by
+	// the acquirer, so leave it off if you need the exact value.
+	NormalizeWhitespace bool
+
+	// UnsignedErrors accepts AcquirerErrorRes messages without validating
+	// their signature. Only set this for acquirers that don't sign error
+	// responses, as it allows a forged error to abort a legitimate transaction.
+	UnsignedErrors bool
+
+	// NumericUTCOffset writes the UTC offset of createDateTimestamp as
+	// "+00:00" instead of "Z", for acquirers that require it. The timestamp
+	// is always in UTC.
+	NumericUTCOffset bool
+
+	// CheckAcquirerKeyName verifies that the KeyName in the signature of
+	// responses (if present) is the fingerprint of AcquirerCert. This detects
+	// key rotation and misrouted requests early.
+	CheckAcquirerKeyName bool
+
+	// UnknownAcquirerKeyName, when set, is called with the KeyName of a
+	// response signature when it isn't the fingerprint of AcquirerCert. This
+	// usually means the acquirer started using a new certificate (or is about
+	// to), so it can be used to alert operators to update AcquirerCert. It is
+	// called before the signature is verified, as verification will fail
+	// once the new certificate uses a new key.
+	UnknownAcquirerKeyName func(keyName string)
+
+	// KeepMessages keeps the signed request of a transaction after it has been
+	// started and the response of status requests, for debugging. See the
+	// SignedRequest method of transactions and the RawResponse field of
+	// transaction statuses.
+	KeepMessages bool
+
+	// Languages lists the languages in which the consumer should see the bank
+	// pages, in order of preference. The first language that is supported (see
+	// SupportedLanguages) is used. The directory does not tell which languages
+	// a bank supports, so this list is all that can be checked. When none of
+	// the languages is supported, "nl" is used.
+	Languages []string
+
+	// OmitLanguage leaves out the (optional) language element from
+	// transaction requests, for acquirers that reject it. The bank then
+	// chooses the language.
+	OmitLanguage bool
+
+	// KeepIssuerIDCase sends the issuer ID exactly as passed to
+	// NewTransaction. By default it is converted to uppercase, as issuer IDs
+	// are BICs and some acquirers reject them in lowercase.
+	KeepIssuerIDCase bool
+
+	// ExpectContinue sends an "Expect: 100-continue" header with requests, so
+	// that the request body is only sent after the server (or a proxy in front
+	// of it) accepts the request. Go doesn't send this header by default, and
+	// there is usually no reason to: only set it when a gateway in front of
+	// the acquirer requires it.
+	ExpectContinue bool
+
+	// CacheDirectory makes DirectoryRequest return the last fetched directory
+	// as long as it is younger than the DirectoryInterval of the iDeal or iDIN
+	// client, instead of doing a new request. Check Directory.Fetched to see
+	// when it was fetched. The returned directory is shared, so don't modify
+	// it.
+	CacheDirectory bool
+
+	// ServeStaleDirectory makes DirectoryRequest return the last fetched
+	// directory together with the error when a new directory could not be
+	// fetched, so that a list of banks can still be shown while the acquirer
+	// is unreachable. Only used with CacheDirectory.
+	ServeStaleDirectory bool
+
+	// MaxIssuers is the maximum number of issuers accepted in a directory
+	// response, to bound the memory used by a malformed response. Defaults to
+	// 10000, far more than there are banks.
+	MaxIssuers int
+
+	// MessageIDAttribute is the name of an ID attribute (usually "ID" or
+	// "Id") to add to the root element of outgoing messages, with a random
+	// value. The signature then references the message by this ID (e.g.
+	// URI="#_1a2b...") instead of using an empty URI, which is what some
+	// acquirers require. By default no ID attribute is added.
+	MessageIDAttribute string
+
+	// C14NPrefixList is the space-separated InclusiveNamespaces prefix list
+	// used for exclusive canonicalization when signing. The default (empty)
+	// is correct for iDeal, and for iDIN as well because the SAML namespaces
+	// are declared on the elements that use them. Some acquirers do however
+	// expect "samlp saml" for iDIN messages.
+	C14NPrefixList string
+
+	// Rand is the source of randomness used to generate IDs and tokens (see
+	// NewSAMLID, GenerateEntranceCode and MessageIDAttribute) and the nonces
+	// of AuditRecord.MarshalEncrypted. Defaults to crypto/rand.Reader. It may
+	// be replaced to get reproducible results in tests, but must be
+	// cryptographically secure in production.
+	Rand io.Reader
+
+	// Signer and Verifier replace the built-in XML signature implementation
+	// (based on goxmldsig), e.g. to sign using an HSM. When nil, the built-in
+	// implementation is used.
+	Signer   Signer
+	Verifier Verifier
+
+	// OnValidated, when set, is called with every response after its
+	// signature has been validated and before it is parsed, for custom checks
+	// or logging. The element it gets is the signed (trusted) content. When it
+	// returns an error, the request fails with that error.
+	OnValidated func(root *etree.Element) error
+
+	// OnRequest and OnResponse, when set, are called with every request to
+	// the acquirer (after signing) and every response (before validation),
+	// e.g. to keep a log of all messages for dispute resolution. The body
+	// must not be modified. Responses are passed regardless of their HTTP
+	// status.
+	OnRequest  func(method, url string, body []byte)
+	OnResponse func(status int, body []byte)
+
+	state atomic.Value // *clientState, created on first use, see getState
+}
+
+// clientState is the mutable state of a client. It is kept behind a pointer
+// so that a CommonClient can still be copied (see With), and belongs to the
+// client it was created for: a copy of a client, for example an IDealClient
+// and an IDINClient created from the same CommonClient, gets its own state
+// instead of sharing the cached directory of the original.
+type clientState struct {
+	owner *CommonClient // the client this state was created for
+
+	// mu guards the fields below. It is only held briefly, never during a
+	// request to the acquirer.
+	mu sync.Mutex
+
+	directory      *Directory      // last directory that was fetched successfully
+	directoryErr   error           // *DirectoryParseError returned with directory, if any
+	directoryFetch *directoryFetch // directory request in progress, if any
+	healthChecked  time.Time       // when HealthCheck last did a request
+	healthErr      error           // the result of that request
+
+	leaf *x509.Certificate // parsed leaf of Certificate, see leafCertificate
+
+	rootCAs       *x509.CertPool // the RootCAs that rootCAsClient was created for
+	rootCAsClient *http.Client   // HTTP client for RootCAs, see httpClient
+
+	// iDeal transactions that are being started or were started successfully,
+	// by purchase ID. See IDealClient.DuplicatePurchaseIDWindow.
+	startedTransactions map[string]*startedTransaction
+}
+
+// directoryFetch is a directory request in progress, which concurrent callers
+// wait for instead of doing their own request.
+type directoryFetch struct {
+	done      chan struct{} // closed when the request is done
+	directory *Directory
+	err       error
+}
+
+// startedTransaction is an iDeal transaction that is being started or was
+// started successfully.
+type startedTransaction struct {
+	started      time.Time
+	contentHash  string
+	entranceCode string
+	done         chan struct{} // closed when starting the transaction is done
+
+	// Only set when done is closed. The transaction ID is empty when the
+	// transaction could not be started.
+	issuerAuthenticationURL string
+	transactionID           string
+}
+
+// getState returns the mutable state of the client, creating it if needed.
+// State that was copied from another client is replaced.
+func (c *CommonClient) getState() *clientState {
+	for {
+		old := c.state.Load()
+		if state, _ := old.(*clientState); state != nil && state.owner == c {
+			return state
+		}
+		c.state.CompareAndSwap(old, &clientState{owner: c})
+	}
+}
+
+// cachedDirectory returns the directory from fetchDirectory. When
+// CacheDirectory is set, the last directory is returned instead when it is
+// younger than interval.
+func (c *CommonClient) cachedDirectory(ctx context.Context, interval time.Duration, fetch func(context.Context) (*Directory, error)) (*Directory, error) {
+	state := c.getState()
+	state.mu.Lock()
+	last, lastErr := state.directory, state.directoryErr
+	state.mu.Unlock()
+	if c.CacheDirectory && last != nil && time.Since(last.Fetched) < interval {
+		return last, lastErr
+	}
+	directory, err := c.fetchDirectory(ctx, fetch)
+	if err != nil && directory == nil && c.CacheDirectory && c.ServeStaleDirectory {
+		state.mu.Lock()
+		last = state.directory
+		state.mu.Unlock()
+		if last != nil {
+			return last, err
+		}
+	}
+	return directory, err
+}
+
+// fetchDirectory does a directory request using fetch, and stores the result
+// as the last successfully fetched directory. A directory with some malformed
+// issuers (returned with a *DirectoryParseError) counts as successful. Only
+// one directory request is done at a time: when one is already in progress,
+// its result is returned instead, unless ctx is done first.
+func (c *CommonClient) fetchDirectory(ctx context.Context, fetch func(context.Context) (*Directory, error)) (*Directory, error) {
+	state := c.getState()
+	for {
+		state.mu.Lock()
+		current := state.directoryFetch
+		if current == nil {
+			current = &directoryFetch{done: make(chan struct{})}
+			state.directoryFetch = current
+			state.mu.Unlock()
+			current.directory, current.err = fetch(ctx)
+			state.mu.Lock()
+			if current.err == nil || current.directory != nil && isDirectoryParseError(current.err) {
+				state.directory = current.directory
+				state.directoryErr = current.err
+			}
+			state.directoryFetch = nil
+			state.mu.Unlock()
+			close(current.done)
+			return current.directory, current.err
+		}
+		state.mu.Unlock()
+
+		select {
+		case <-current.done:
+		case <-ctx.Done():
+			return nil, timeoutError(ctx.Err())
+		}
+		// Do a new request when the caller that did this one cancelled it.
+		if !errors.Is(current.err, context.Canceled) || ctx.Err() != nil {
+			return current.directory, current.err
+		}
+	}
+}
+
+// isDirectoryParseError returns whether err is a *DirectoryParseError, which is
+// returned together with a usable directory.
+func isDirectoryParseError(err error) bool {
+	var parseErr *DirectoryParseError
+	return errors.As(err, &parseErr)
+}
+
+// SupportedLanguages are the languages (as ISO 639-1 codes) that banks must
+// support for the iDeal and iDIN bank pages.
+var SupportedLanguages = []string{"nl", "en"}
+
+// ClientOptions holds the required settings of a client, see NewIDealClient
+// and NewIDINClient. Other settings can be changed on the returned client.
+type ClientOptions struct {
+	BaseURL      string            // The API endpoint to use, as provided by your bank.
+	MerchantID   string            // Merchant ID, as provided by your bank.
+	SubID        string            // "0" (or empty) if you don't use sub IDs.
+	ReturnURL    string            // The URL to return to after the iDeal/iDIN transaction is complete.
+	Certificate  tls.Certificate   // Your certificate, with which to sign outgoing messages.
+	AcquirerCert *x509.Certificate // The certificate of the bank, with which to verify incoming messages.
+}
+
+// newCommonClient creates a CommonClient from the options and validates it.
+func newCommonClient(opts ClientOptions) (CommonClient, error) {
+	c := CommonClient{
+		BaseURL:      opts.BaseURL,
+		MerchantID:   opts.MerchantID,
+		SubID:        opts.SubID,
+		ReturnURL:    opts.ReturnURL,
+		Certificate:  opts.Certificate,
+		AcquirerCert: opts.AcquirerCert,
+	}
+	return c, c.Validate()
+}
+
+// An Option overrides a setting of a CommonClient, see CommonClient.With.
+type Option func(*CommonClient)
+
+// WithBaseURL overrides the BaseURL of a client.
+func WithBaseURL(url string) Option {
+	return func(c *CommonClient) {
+		c.BaseURL = url
+	}
+}
+
+// WithMerchantID overrides the MerchantID of a client.
+func WithMerchantID(merchantID string) Option {
+	return func(c *CommonClient) {
+		c.MerchantID = merchantID
+	}
+}
+
+// WithSubID overrides the SubID of a client.
+func WithSubID(subID string) Option {
+	return func(c *CommonClient) {
+		c.SubID = subID
+	}
+}
+
+// WithReturnURL overrides the ReturnURL of a client.
+func WithReturnURL(url string) Option {
+	return func(c *CommonClient) {
+		c.ReturnURL = url
+	}
+}
+
+// With returns a copy of the client with the given options applied. The
+// certificates are shared with the original client, which is safe as they are
+// never modified. This is useful for multi-tenant setups where clients only
+// differ in e.g. ReturnURL or SubID. Cached state, like the last fetched
+// directory, is not shared.
+func (c CommonClient) With(opts ...Option) CommonClient {
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// IncompleteChainError is returned by Validate when the configured certificate
+// chain appears to be missing the certificate that issued the leaf. Some
+// acquirers require the full chain and will reject signed messages otherwise.
+type IncompleteChainError struct {
+	Issuer string // Distinguished name of the missing issuer certificate.
+}
+
+func (e *IncompleteChainError) Error() string {
+	return "idx: certificate chain is incomplete: issuer " + e.Issuer + " is missing"
+}
+
+// Validate checks the client configuration for common mistakes, so they can be
+// caught before going live instead of resulting in an error from the acquirer.
+//
+// It returns an *IncompleteChainError when the leaf certificate is not
+// self-signed and its issuer is not present in Certificate.Certificate. This is
+// only a warning for acquirers that don't require the full chain.
+func (c *CommonClient) Validate() error {
+	if c.BaseURL == "" {
+		return errors.New("idx: BaseURL is not set")
+	}
+	if c.MerchantID == "" {
+		return errors.New("idx: MerchantID is not set")
+	}
+	if c.ReturnURL == "" {
+		return errors.New("idx: ReturnURL is not set")
+	}
+	if c.AcquirerCert == nil {
+		return errors.New("idx: AcquirerCert is not set")
+	}
+	if len(c.Certificate.Certificate) == 0 || c.Certificate.PrivateKey == nil {
+		return errors.New("idx: Certificate is not set")
+	}
+
+	// Check whether the chain is complete.
+	leaf, err := c.leafCertificate()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(leaf.RawIssuer, leaf.RawSubject) {
+		// Self-signed, nothing to check.
+		return nil
+	}
+	for _, der := range c.Certificate.Certificate[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(cert.RawSubject, leaf.RawIssuer) {
+			return nil
+		}
+	}
+	return &IncompleteChainError{Issuer: leaf.Issuer.String()}
+}
+
+// leafCertificate returns the parsed leaf of Certificate. It uses
+// Certificate.Leaf when set, and otherwise parses the certificate once and
+// caches the result.
+func (c *CommonClient) leafCertificate() (*x509.Certificate, error) {
+	if c.Certificate.Leaf != nil {
+		return c.Certificate.Leaf, nil
+	}
+	if len(c.Certificate.Certificate) == 0 {
+		return nil, errors.New("idx: Certificate is not set")
+	}
+	der := c.Certificate.Certificate[0]
+	state := c.getState()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	// Compare with the cached certificate, in case Certificate was changed.
+	if state.leaf == nil || !bytes.Equal(state.leaf.Raw, der) {
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		state.leaf = leaf
+	}
+	return state.leaf, nil
+}
+
+// CheckCertificateRequirements checks whether the given certificate can be used
+// to sign iDeal/iDIN messages: it must have an RSA key of at least 2048 bits
+// matching the private key, and must not be signed using MD5 or SHA-1. Use it
+// before uploading a newly generated certificate to your bank.
+//
+// All problems that are found are listed in the returned error.
+func CheckCertificateRequirements(cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("idx: certificate: no certificate present")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	var problems []string
+	if publicKey, ok := leaf.PublicKey.(*rsa.PublicKey); !ok {
+		problems = append(problems, "key is not an RSA key")
+	} else {
+		if publicKey.N.BitLen() < 2048 {
+			problems = append(problems, "RSA key is "+strconv.Itoa(publicKey.N.BitLen())+" bits, must be at least 2048 bits")
+		}
+		if privateKey, ok := cert.PrivateKey.(*rsa.PrivateKey); !ok {
+			problems = append(problems, "private key is not an RSA key")
+		} else if !privateKey.PublicKey.Equal(publicKey) {
+			problems = append(problems, "private key does not match certificate")
+		}
+	}
+	switch leaf.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		problems = append(problems, "certificate is signed using "+leaf.SignatureAlgorithm.String()+", which is not allowed")
+	}
+
+	if len(problems) != 0 {
+		return errors.New("idx: certificate: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// normalize returns s with leading and trailing whitespace removed and internal
+// whitespace collapsed, if NormalizeWhitespace is set.
+func (c *CommonClient) normalize(s string) string {
+	if !c.NormalizeWhitespace {
+		return s
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// timestamp formats t in UTC for use in createDateTimestamp.
+func (c *CommonClient) timestamp(t time.Time) string {
+	offset := "Z"
+	if c.NumericUTCOffset {
+		offset = "+00:00"
+	}
+	return t.UTC().Format("2006-01-02T15:04:05") + offset
 }
 
 func (c *CommonClient) createMessage(tag string) *etree.Element {
 	msg := &etree.Element{
 		Tag: tag,
 	}
-	msg.CreateElement("createDateTimestamp").SetText(time.Now().UTC().Format(time.RFC3339))
+	msg.CreateElement("createDateTimestamp").SetText(c.timestamp(time.Now()))
 	merchant := msg.CreateElement("Merchant")
 	merchant.CreateElement("merchantID").SetText(c.MerchantID)
-	merchant.CreateElement("subID").SetText(c.SubID)
+	merchant.CreateElement("subID").SetText(subIDOrDefault(c.SubID))
 	return msg
 }
 
-func (c *CommonClient) request(msg string) (*etree.Document, error) {
-	body := bytes.NewBufferString(msg)
-	req, err := http.NewRequest("POST", c.BaseURL, body)
+// subIDOrDefault returns "0" for an empty sub ID. The subID element is
+// required, and an empty element is rejected by some acquirers.
+func subIDOrDefault(subID string) string {
+	if subID == "" {
+		return "0"
+	}
+	return subID
+}
+
+// The HTTP client used for requests to the acquirer. It has its own transport
+// instead of using http.DefaultClient, so that changes made to the default
+// client or transport elsewhere in the process don't affect it. Sharing it
+// between clients is safe: it holds no per-client state besides pooled
+// connections, and messages are signed and validated per client.
+var defaultHTTPClient = &http.Client{
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+}
+
+// httpClient returns the HTTP client to use for requests to the acquirer.
+func (c *CommonClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	if c.RootCAs == nil {
+		return defaultHTTPClient
+	}
+	// Keep the HTTP client for RootCAs with the client, so that connections
+	// are reused between requests. Compare with the pool it was created for,
+	// in case RootCAs was changed.
+	state := c.getState()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.rootCAsClient == nil || state.rootCAs != c.RootCAs {
+		if state.rootCAsClient != nil {
+			state.rootCAsClient.CloseIdleConnections()
+		}
+		transport := defaultHTTPClient.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: c.RootCAs}
+		state.rootCAs = c.RootCAs
+		state.rootCAsClient = &http.Client{Transport: transport}
+	}
+	return state.rootCAsClient
+}
+
+// Maximum size of a response body. Responses are much smaller in practice, but
+// the limit avoids reading an unbounded amount of data from a misbehaving
+// server.
+const maxResponseSize = 4 * 1024 * 1024
+
+// RateLimitError is returned when the acquirer responds with HTTP status 429
+// (Too Many Requests). You should not do another request before RetryAfter
+// has passed.
+type RateLimitError struct {
+	RetryAfter time.Duration // Zero if the acquirer did not send a (valid) Retry-After header.
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter == 0 {
+		return "idx: rate limited"
+	}
+	return "idx: rate limited, retry after " + e.RetryAfter.String()
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// language returns the first supported language of c.Languages.
+func (c *CommonClient) language() string {
+	for _, language := range c.Languages {
+		for _, supported := range SupportedLanguages {
+			if language == supported {
+				return language
+			}
+		}
+	}
+	return "nl"
+}
+
+// createTransaction adds the elements common to iDeal and iDIN AcquirerTrxReq
+// messages to msg, and returns the Transaction element.
+func (c *CommonClient) createTransaction(msg *etree.Element, issuer, entranceCode string) *etree.Element {
+	msg.SelectElement("Merchant").CreateElement("merchantReturnURL").SetText(c.ReturnURL)
+	if !c.KeepIssuerIDCase {
+		issuer = strings.ToUpper(issuer)
+	}
+	msg.CreateElement("Issuer").CreateElement("issuerID").SetText(issuer)
+	transaction := msg.CreateElement("Transaction")
+	if !c.OmitLanguage {
+		transaction.CreateElement("language").SetText(c.language())
+	}
+	transaction.CreateElement("entranceCode").SetText(entranceCode)
+	return transaction
+}
+
+// ErrTimeout is matched (with errors.Is) by the error returned when a request
+// to the acquirer timed out, because of CommonClient.Timeout, the deadline of
+// the context or the timeout of a custom HTTPClient. The error also wraps the
+// original error, so it matches context.DeadlineExceeded as well when that was
+// the cause. The request may or may not have been processed by the acquirer. A
+// request aborted by cancelling the context returns an error matching
+// context.Canceled instead.
+var ErrTimeout = errors.New("idx: request to acquirer timed out")
+
+// wrappedTimeoutError is ErrTimeout with the error that caused it.
+type wrappedTimeoutError struct {
+	err error
+}
+
+func (e wrappedTimeoutError) Error() string {
+	return ErrTimeout.Error() + ": " + e.err.Error()
+}
+
+func (e wrappedTimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e wrappedTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// timeoutError returns an error matching ErrTimeout and wrapping err for errors
+// caused by a timeout, and err otherwise.
+func timeoutError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return wrappedTimeoutError{err}
+	}
+	return err
+}
+
+// setLanguage sets the language element of the Transaction in msg, creating it
+// when it was left out because of OmitLanguage.
+func setLanguage(msg *etree.Element, language string) error {
+	for _, supported := range SupportedLanguages {
+		if language == supported {
+			transaction := msg.SelectElement("Transaction")
+			el := transaction.SelectElement("language")
+			if el == nil {
+				el = transaction.CreateElement("language")
+			}
+			el.SetText(language)
+			return nil
+		}
+	}
+	return errors.New("idx: unsupported language: " + language)
+}
+
+// request sends the signed message to the acquirer, and returns the parsed
+// response together with the response body as it was received.
+func (c *CommonClient) request(ctx context.Context, msg []byte) (*etree.Document, []byte, error) {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL, bytes.NewReader(msg))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	req.Header.Add("Content-Type", "text/xml; charset=\"utf-8\"")
 	req.Header.Add("Version", "1.0")
 	req.Header.Add("Encoding", "UTF-8")
-	resp, err := http.DefaultClient.Do(req)
+	if c.ExpectContinue {
+		req.Header.Add("Expect", "100-continue")
+	}
+	if c.OnRequest != nil {
+		c.OnRequest(req.Method, c.BaseURL, msg)
+	}
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, timeoutError(err)
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, nil, timeoutError(err)
+	}
+	if c.OnResponse != nil {
+		c.OnResponse(resp.StatusCode, body)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, nil, &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New("idx: HTTP error: " + resp.Status)
+		return nil, nil, errors.New("idx: HTTP error: " + resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+		// Most likely an error page of a proxy or gateway in front of the
+		// acquirer, which would otherwise result in a cryptic XML syntax
+		// error.
+		snippet := body
+		if len(snippet) > 200 {
+			snippet = snippet[:200]
+		}
+		return nil, nil, errors.New("idx: acquirer returned text/html instead of XML, likely a gateway error page: " + strings.Join(strings.Fields(string(snippet)), " "))
 	}
 
 	doc := etree.NewDocument()
-	_, err = doc.ReadFrom(resp.Body)
-	if err != nil {
-		return nil, err
+	if err := doc.ReadFromBytes(body); err != nil {
+		return nil, nil, err
 	}
-	return doc, nil
+	if doc.Root() == nil {
+		return nil, nil, errors.New("idx: empty response")
+	}
+	return doc, body, nil
 }
 
-func (c *CommonClient) signMessage(msg *etree.Element) string {
-	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(c.Certificate))
-	ctx.Prefix = ""
-	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
-	signed, err := ctx.SignEnveloped(msg)
-	if err != nil {
-		panic(err)
+// signMessage signs the message and serializes it. Signing errors are
+// returned instead of causing a panic, as they may be caused by a custom Signer
+// (e.g. a HSM that is temporarily unreachable).
+func (c *CommonClient) signMessage(msg *etree.Element) ([]byte, error) {
+	orderElements(msg)
+	signer := c.Signer
+	if signer == nil {
+		signer = defaultSigner{c}
 	}
-
-	keyName := sha1.Sum(c.Certificate.Certificate[0])
-	keyNameString := strings.ToUpper(hex.EncodeToString(keyName[:]))
-
-	keyInfo := signed.FindElement("/Signature/KeyInfo")
-	// remove existing children
-	for _, child := range keyInfo.ChildElements() {
-		keyInfo.RemoveChild(child)
+	signed, err := signer.Sign(msg)
+	if err != nil {
+		return nil, errors.New("idx: could not sign message: " + err.Error())
 	}
-	// Insert custom KeyName element
-	keyInfo.CreateElement("KeyName").SetText(keyNameString)
 
+	// Serialize directly into the buffer that is used as request body, to
+	// avoid copying the message around.
 	doc := etree.NewDocument()
 	doc.SetRoot(signed)
-	str, err := doc.WriteToString()
-	if err != nil {
-		panic(err)
+	buf := bytes.NewBufferString(xml.Header)
+	if _, err := doc.WriteTo(buf); err != nil {
+		return nil, err
 	}
 
-	return xml.Header + str
+	return buf.Bytes(), nil
 }
 
-func (c *CommonClient) validateMessage(msg *etree.Document) (*etree.Element, error) {
-	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
-		Roots: []*x509.Certificate{c.AcquirerCert},
-	})
+// UnexpectedResponseError is returned when the acquirer responds with a
+// different message than expected for the request, e.g. because of a
+// misconfigured BaseURL.
+type UnexpectedResponseError struct {
+	Got  string // Root element of the response.
+	Want string // Expected root element.
+}
+
+func (e *UnexpectedResponseError) Error() string {
+	return "idx: unexpected response: got " + e.Got + ", want " + e.Want
+}
+
+// validateMessage checks that the response is of the expected message type
+// (root element) and validates its signature. It returns the signed root
+// element.
+//
+// To protect against signature wrapping attacks, where a signed element is
+// moved elsewhere in the document next to unsigned content, the signature must
+// be a direct child of the root element and its only reference must point to
+// the root element. Additionally, the element returned by the Verifier must be
+// the expected message type, and only that element is used afterwards.
+func (c *CommonClient) validateMessage(msg *etree.Document, expected string) (*etree.Element, error) {
+	root := msg.Root()
+	if tag := root.Tag; tag != expected {
+		return nil, &UnexpectedResponseError{Got: tag, Want: expected}
+	}
+
+	signatures := root.SelectElements("Signature")
+	if len(signatures) != 1 {
+		return nil, errors.New("idx: response must have exactly one signature on the root element")
+	}
+	references := signatures[0].FindElements("SignedInfo/Reference")
+	if len(references) != 1 {
+		return nil, errors.New("idx: response signature must have exactly one reference")
+	}
+	if uri := references[0].SelectAttrValue("URI", ""); uri != "" && !isRootReference(root, uri) {
+		return nil, errors.New("idx: response signature does not reference the root element: " + uri)
+	}
+
+	if c.CheckAcquirerKeyName || c.UnknownAcquirerKeyName != nil {
+		if c.AcquirerCert == nil {
+			return nil, errors.New("idx: AcquirerCert is not set")
+		}
+		if el := msg.Root().FindElement("Signature/KeyInfo/KeyName"); el != nil {
+			if name, expected := strings.TrimSpace(el.Text()), keyName(c.AcquirerCert.Raw); !strings.EqualFold(name, expected) {
+				if c.UnknownAcquirerKeyName != nil {
+					c.UnknownAcquirerKeyName(name)
+				}
+				if c.CheckAcquirerKeyName {
+					return nil, errors.New("idx: response signed with key " + name + ", expected " + expected)
+				}
+			}
+		}
+	}
 
-	return ctx.Validate(msg.ChildElements()[0])
+	verifier := c.Verifier
+	if verifier == nil {
+		verifier = defaultVerifier{c}
+	}
+	signed, err := verifier.Verify(root)
+	if err != nil {
+		return nil, err
+	}
+	if signed.Tag != expected {
+		return nil, errors.New("idx: signed element is " + signed.Tag + ", expected " + expected)
+	}
+	if c.OnValidated != nil {
+		if err := c.OnValidated(signed); err != nil {
+			return nil, err
+		}
+	}
+	return signed, nil
 }
 
-func (c *CommonClient) parseDirectoryRequest(msg *etree.Element) *Directory {
-	directory := &Directory{
-		Issuers: make(map[string][]Issuer),
+// isRootReference returns whether the signature reference URI (e.g. "#_abc")
+// points to the ID attribute of the root element.
+func isRootReference(root *etree.Element, uri string) bool {
+	if !strings.HasPrefix(uri, "#") {
+		return false
 	}
-	for _, countryEl := range msg.FindElements("/Directory/Country") {
-		countryName := countryEl.FindElement("countryNames").Text()
-		for _, issuerEl := range countryEl.FindElements("Issuer") {
-			issuerID := issuerEl.FindElement("issuerID").Text()
-			issuerName := issuerEl.FindElement("issuerName").Text()
-			directory.Issuers[countryName] = append(directory.Issuers[countryName], Issuer{issuerID, issuerName})
+	for _, attr := range []string{"ID", "Id", "id"} {
+		if id := root.SelectAttrValue(attr, ""); id != "" && id == uri[1:] {
+			return true
 		}
 	}
-	return directory
+	return false
 }
 
-// The directory listing, as returned from a directory request.
-// It is a map from country name to a list of issuers in that country.
-type Directory struct {
-	Issuers map[string][]Issuer `json:"issuers"`
+// findText returns the text of the element at the given path, or an error if
+// there is no such element. Responses come from the network, so they can't be
+// assumed to contain all required elements.
+func findText(el *etree.Element, path string) (string, error) {
+	found := el.FindElement(path)
+	if found == nil {
+		return "", errors.New("idx: missing element in response: " + path)
+	}
+	return found.Text(), nil
+}
+
+// optionalText returns the text of the element at the given path, or the empty
+// string if there is no such element.
+func optionalText(el *etree.Element, path string) string {
+	found := el.FindElement(path)
+	if found == nil {
+		return ""
+	}
+	return found.Text()
 }
 
-// A single issuer (bank), as returned in a directory request.
-type Issuer struct {
-	IssuerID   string `json:"issuerID"`   // BIC
-	IssuerName string `json:"issuerName"` // Human-readable name
+// acquirerError parses an AcquirerErrorRes message into an *AcquirerError. The
+// signature of the message is validated first, unless UnsignedErrors is set.
+func (c *CommonClient) acquirerError(doc *etree.Document) error {
+	root := doc.Root()
+	if !c.UnsignedErrors {
+		var err error
+		root, err = c.validateMessage(doc, "AcquirerErrorRes")
+		if err != nil {
+			return err
+		}
+	}
+	return &AcquirerError{
+		ErrorCode:       optionalText(root, "Error/errorCode"),
+		ErrorMessage:    optionalText(root, "Error/errorMessage"),
+		ErrorDetail:     optionalText(root, "Error/errorDetail"),
+		ConsumerMessage: optionalText(root, "Error/consumerMessage"),
+	}
 }
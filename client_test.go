@@ -0,0 +1,704 @@
+package idx
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// Certificates of the merchant and acquirer used in tests.
+var (
+	testMerchantCert = testCertificate("Test merchant")
+	testAcquirerCert = testCertificate("Test acquirer")
+)
+
+// testCertificate returns a new self-signed certificate with the given common
+// name.
+func testCertificate(name string) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// testSigner adds a test signature to messages, with the KeyName of cert.
+type testSigner struct {
+	cert tls.Certificate
+}
+
+func (s testSigner) Sign(msg *etree.Element) (*etree.Element, error) {
+	msg = msg.Copy()
+	addTestSignature(msg, s.cert, "")
+	return msg, nil
+}
+
+// testVerifier accepts messages with a test signature made with cert. Like
+// goxmldsig, it returns a copy of the signed element.
+type testVerifier struct {
+	cert *x509.Certificate
+}
+
+func (v testVerifier) Verify(msg *etree.Element) (*etree.Element, error) {
+	if name := optionalText(msg, "Signature/KeyInfo/KeyName"); name != keyName(v.cert.Raw) {
+		return nil, errors.New("test signature with unknown key: " + name)
+	}
+	return msg.Copy(), nil
+}
+
+// addTestSignature adds a signature element to el, as created by testSigner.
+// It has no actual signature value.
+func addTestSignature(el *etree.Element, cert tls.Certificate, uri string) {
+	signature := el.CreateElement("Signature")
+	signature.CreateAttr("xmlns", "http://www.w3.org/2000/09/xmldsig#")
+	signature.CreateElement("SignedInfo").CreateElement("Reference").CreateAttr("URI", uri)
+	signature.CreateElement("KeyInfo").CreateElement("KeyName").SetText(keyName(cert.Certificate[0]))
+}
+
+// signResponse adds a test signature made with cert to the message.
+func signResponse(cert tls.Certificate, msg string) string {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(msg); err != nil {
+		panic(err)
+	}
+	addTestSignature(doc.Root(), cert, "")
+	s, err := doc.WriteToString()
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// newTestServer starts a mock acquirer, which responds to every request with
+// the message returned by respond.
+func newTestServer(t testing.TB, respond func(req *etree.Element) string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc := etree.NewDocument()
+		if _, err := doc.ReadFrom(r.Body); err != nil || doc.Root() == nil {
+			t.Errorf("could not parse request: %v", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		io.WriteString(w, respond(doc.Root()))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestClient returns a client for the mock acquirer at url, which signs
+// messages with testSigner and accepts responses signed by testAcquirerCert.
+func newTestClient(url string) CommonClient {
+	return CommonClient{
+		BaseURL:      url,
+		MerchantID:   "002054205",
+		SubID:        "0",
+		ReturnURL:    "https://example.com/return",
+		Certificate:  testMerchantCert,
+		AcquirerCert: testAcquirerCert.Leaf,
+		Signer:       testSigner{testMerchantCert},
+		Verifier:     testVerifier{testAcquirerCert.Leaf},
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	server := newTestServer(t, func(req *etree.Element) string {
+		time.Sleep(100 * time.Millisecond)
+		return "<DirectoryRes/>"
+	})
+	c := newTestClient(server.URL)
+	c.Timeout = 10 * time.Millisecond
+
+	// Timeout applies when the context has no deadline.
+	if _, _, err := c.request(context.Background(), []byte("<DirectoryReq/>")); !errors.Is(err, ErrTimeout) {
+		t.Errorf("without deadline: expected ErrTimeout, got %v", err)
+	}
+
+	// The deadline of the context takes precedence over Timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := c.request(ctx, []byte("<DirectoryReq/>")); err != nil {
+		t.Errorf("with longer deadline: expected no error, got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Timeout = 5 * time.Second
+	if _, _, err := c.request(ctx, []byte("<DirectoryReq/>")); !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("with shorter deadline: expected ErrTimeout wrapping context.DeadlineExceeded, got %v", err)
+	}
+
+	// Cancelling the context is not a timeout.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := c.request(ctx, []byte("<DirectoryReq/>")); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: expected context.Canceled, got %v", err)
+	}
+}
+
+// Clients for different acquirer environments must not share any state, like
+// certificates, endpoints or cached directories.
+func TestIndependentClients(t *testing.T) {
+	type environment struct {
+		merchant tls.Certificate
+		acquirer tls.Certificate
+		issuerID string
+		client   *IDealClient
+	}
+	environments := []*environment{
+		{merchant: testCertificate("Merchant A"), acquirer: testCertificate("Acquirer A"), issuerID: "BANKANL2A"},
+		{merchant: testCertificate("Merchant B"), acquirer: testCertificate("Acquirer B"), issuerID: "BANKBNL2B"},
+	}
+	for _, env := range environments {
+		env := env
+		server := newTestServer(t, func(req *etree.Element) string {
+			if name := optionalText(req, "Signature/KeyInfo/KeyName"); name != keyName(env.merchant.Certificate[0]) {
+				t.Errorf("%s: request signed with key %s", env.issuerID, name)
+			}
+			return signResponse(env.acquirer, `<DirectoryRes><Directory><Country><countryNames>Nederland</countryNames><Issuer><issuerID>`+env.issuerID+`</issuerID><issuerName>Bank</issuerName></Issuer></Country></Directory></DirectoryRes>`)
+		})
+		c := newTestClient(server.URL)
+		c.Certificate = env.merchant
+		c.AcquirerCert = env.acquirer.Leaf
+		c.Signer = testSigner{env.merchant}
+		c.Verifier = testVerifier{env.acquirer.Leaf}
+		c.CheckAcquirerKeyName = true
+		c.CacheDirectory = true
+		env.client = &IDealClient{CommonClient: c}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, env := range environments {
+			wg.Add(1)
+			go func(env *environment) {
+				defer wg.Done()
+				directory, err := env.client.DirectoryRequest()
+				if err != nil {
+					t.Errorf("%s: %v", env.issuerID, err)
+					return
+				}
+				if issuers := directory.Issuers["Nederland"]; len(issuers) != 1 || issuers[0].IssuerID != env.issuerID {
+					t.Errorf("%s: got issuers of another environment: %v", env.issuerID, issuers)
+				}
+			}(env)
+		}
+	}
+	wg.Wait()
+}
+
+func BenchmarkSignAndRequest(b *testing.B) {
+	server := newTestServer(b, func(req *etree.Element) string {
+		return "<AcquirerTrxRes/>"
+	})
+	c := &IDINClient{CommonClient: newTestClient(server.URL)}
+	id, err := c.NewSAMLID()
+	if err != nil {
+		b.Fatal(err)
+	}
+	transaction := c.NewTransaction("RABONL2U", "entranceCode", id, IDINServiceIDName|IDINServiceIDAddress|IDINServiceIDDateOfBirth)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		signed, err := c.signMessage(transaction.msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := c.CommonClient.request(context.Background(), signed); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCreateDateTimestamp(t *testing.T) {
+	c := newTestClient("https://example.com/ideal")
+	timestamp := c.createMessage("DirectoryReq").SelectElement("createDateTimestamp").Text()
+	if _, err := time.Parse("2006-01-02T15:04:05Z", timestamp); err != nil {
+		t.Errorf("expected a UTC timestamp ending with Z, got %s", timestamp)
+	}
+
+	c.NumericUTCOffset = true
+	timestamp = c.createMessage("DirectoryReq").SelectElement("createDateTimestamp").Text()
+	if _, err := time.Parse("2006-01-02T15:04:05+00:00", timestamp); err != nil {
+		t.Errorf("expected a UTC timestamp ending with +00:00, got %s", timestamp)
+	}
+
+	// The timestamp is in UTC regardless of the time zone of t.
+	if timestamp := c.timestamp(time.Date(2017, 1, 2, 16, 4, 5, 0, time.FixedZone("CET", 3600))); timestamp != "2017-01-02T15:04:05+00:00" {
+		t.Errorf("expected 2017-01-02T15:04:05+00:00, got %s", timestamp)
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	c := newTestClient(server.URL)
+	_, _, err := c.request(context.Background(), []byte("<DirectoryReq/>"))
+	var rateErr *RateLimitError
+	if !errors.As(err, &rateErr) || rateErr.RetryAfter != 2*time.Minute {
+		t.Errorf("expected RateLimitError with RetryAfter 2m0s, got %v", err)
+	}
+}
+
+// parseTestResponse parses a response message for validateMessage.
+func parseTestResponse(t *testing.T, msg string) *etree.Document {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(msg); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestAcquirerKeyName(t *testing.T) {
+	c := newTestClient("https://example.com/ideal")
+	other := testCertificate("Other acquirer")
+	// Accept the signature itself, so that only the KeyName check fails.
+	c.Verifier = testVerifier{other.Leaf}
+	var unknown string
+	c.UnknownAcquirerKeyName = func(name string) {
+		unknown = name
+	}
+	doc := parseTestResponse(t, signResponse(other, "<DirectoryRes/>"))
+
+	if _, err := c.validateMessage(doc, "DirectoryRes"); err != nil {
+		t.Errorf("without CheckAcquirerKeyName: expected no error, got %v", err)
+	}
+	if unknown != keyName(other.Certificate[0]) {
+		t.Errorf("UnknownAcquirerKeyName called with %q", unknown)
+	}
+
+	c.CheckAcquirerKeyName = true
+	if _, err := c.validateMessage(doc, "DirectoryRes"); err == nil {
+		t.Error("with CheckAcquirerKeyName: expected an error for a mismatched KeyName")
+	}
+
+	// A signature with the expected KeyName is accepted.
+	c.Verifier = testVerifier{testAcquirerCert.Leaf}
+	if _, err := c.validateMessage(parseTestResponse(t, signResponse(testAcquirerCert, "<DirectoryRes/>")), "DirectoryRes"); err != nil {
+		t.Errorf("with matching KeyName: expected no error, got %v", err)
+	}
+}
+
+// When the acquirer rotates its certificate, responses signed with the new key
+// are reported until the new certificate is configured.
+func TestAcquirerKeyNameRotation(t *testing.T) {
+	rotated := testCertificate("Test acquirer (rotated)")
+	c := newTestClient("https://example.com/ideal")
+	c.CheckAcquirerKeyName = true
+	var unknown []string
+	c.UnknownAcquirerKeyName = func(name string) {
+		unknown = append(unknown, name)
+	}
+	c.Verifier = testVerifier{rotated.Leaf}
+	doc := parseTestResponse(t, signResponse(rotated, "<DirectoryRes/>"))
+	if _, err := c.validateMessage(doc, "DirectoryRes"); err == nil {
+		t.Error("expected an error for the key of the rotated certificate")
+	}
+	if len(unknown) != 1 || unknown[0] != keyName(rotated.Certificate[0]) {
+		t.Errorf("expected the rotated key to be reported, got %v", unknown)
+	}
+
+	c.AcquirerCert = rotated.Leaf
+	if _, err := c.validateMessage(doc, "DirectoryRes"); err != nil || len(unknown) != 1 {
+		t.Errorf("after configuring the rotated certificate: expected no error or report, got %v, %v", err, unknown)
+	}
+
+	// Without an acquirer certificate, there is nothing to compare with.
+	c.AcquirerCert = nil
+	if _, err := c.validateMessage(doc, "DirectoryRes"); err == nil {
+		t.Error("without AcquirerCert: expected an error")
+	}
+}
+
+func TestUnexpectedResponse(t *testing.T) {
+	c := newTestClient("https://example.com/ideal")
+	for _, tc := range []struct {
+		got, want string
+	}{
+		{"AcquirerTrxRes", "DirectoryRes"},
+		{"AcquirerStatusRes", "DirectoryRes"},
+		{"DirectoryRes", "AcquirerTrxRes"},
+		{"AcquirerStatusRes", "AcquirerTrxRes"},
+		{"DirectoryRes", "AcquirerStatusRes"},
+		{"AcquirerTrxRes", "AcquirerStatusRes"},
+	} {
+		doc := parseTestResponse(t, signResponse(testAcquirerCert, "<"+tc.got+"/>"))
+		_, err := c.validateMessage(doc, tc.want)
+		var unexpectedErr *UnexpectedResponseError
+		if !errors.As(err, &unexpectedErr) || unexpectedErr.Got != tc.got || unexpectedErr.Want != tc.want {
+			t.Errorf("%s for %s: expected an UnexpectedResponseError, got %v", tc.got, tc.want, err)
+		}
+		// The same message is accepted where it is expected.
+		if _, err := c.validateMessage(doc, tc.got); err != nil {
+			t.Errorf("%s: expected no error, got %v", tc.got, err)
+		}
+	}
+}
+
+func TestHTMLErrorPage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html>\n<body>\n<h1>502 Bad Gateway</h1>\n</body>\n</html>\n")
+	}))
+	defer server.Close()
+	c := newTestClient(server.URL)
+	_, _, err := c.request(context.Background(), []byte("<DirectoryReq/>"))
+	if err == nil || !strings.Contains(err.Error(), "text/html") || !strings.Contains(err.Error(), "<h1>502 Bad Gateway</h1>") {
+		t.Errorf("expected an error with a snippet of the HTML page, got %v", err)
+	}
+}
+
+// Responses where the signature does not cover the root element, as in a
+// signature wrapping attack, must be rejected.
+func TestSignatureWrapping(t *testing.T) {
+	c := newTestClient("https://example.com/ideal")
+	const forged = `<AcquirerStatusRes><Transaction><transactionID>0030000123456789</transactionID><status>Success</status></Transaction></AcquirerStatusRes>`
+	const original = `<AcquirerStatusRes ID="_original"><Transaction><transactionID>0030000123456789</transactionID><status>Cancelled</status></Transaction></AcquirerStatusRes>`
+
+	// The signed original is moved into the signature of a forged response,
+	// and referenced by ID.
+	wrapped := parseTestResponse(t, forged)
+	addTestSignature(wrapped.Root(), testAcquirerCert, "#_original")
+	wrapped.Root().SelectElement("Signature").CreateElement("Object").AddChild(parseTestResponse(t, original).Root())
+	if _, err := c.validateMessage(wrapped, "AcquirerStatusRes"); err == nil {
+		t.Error("wrapped original: expected an error")
+	}
+
+	// The signature is not on the root element.
+	nested := parseTestResponse(t, forged)
+	addTestSignature(nested.Root().SelectElement("Transaction"), testAcquirerCert, "")
+	if _, err := c.validateMessage(nested, "AcquirerStatusRes"); err == nil {
+		t.Error("nested signature: expected an error")
+	}
+
+	// An unsigned signature next to a signed one.
+	double := parseTestResponse(t, signResponse(testAcquirerCert, forged))
+	addTestSignature(double.Root(), testAcquirerCert, "")
+	if _, err := c.validateMessage(double, "AcquirerStatusRes"); err == nil {
+		t.Error("two signatures: expected an error")
+	}
+
+	// The Verifier returns another element than the root.
+	c.Verifier = wrappedVerifier{}
+	if _, err := c.validateMessage(parseTestResponse(t, signResponse(testAcquirerCert, forged)), "AcquirerStatusRes"); err == nil {
+		t.Error("other signed element: expected an error")
+	}
+
+	// A reference to the ID of the root element is accepted.
+	c.Verifier = testVerifier{testAcquirerCert.Leaf}
+	byID := parseTestResponse(t, original)
+	addTestSignature(byID.Root(), testAcquirerCert, "#_original")
+	signed, err := c.validateMessage(byID, "AcquirerStatusRes")
+	if err != nil {
+		t.Fatalf("reference to root: expected no error, got %v", err)
+	}
+	if status := optionalText(signed, "Transaction/status"); status != "Cancelled" {
+		t.Errorf("reference to root: got status %s", status)
+	}
+}
+
+// wrappedVerifier returns the Transaction element as the signed element.
+type wrappedVerifier struct{}
+
+func (wrappedVerifier) Verify(msg *etree.Element) (*etree.Element, error) {
+	return msg.SelectElement("Transaction").Copy(), nil
+}
+
+func TestLeafCertificate(t *testing.T) {
+	// A pre-parsed leaf is used as is.
+	c := newTestClient("https://example.com/ideal")
+	if leaf, err := c.leafCertificate(); err != nil || leaf != testMerchantCert.Leaf {
+		t.Errorf("with leaf: expected the pre-parsed leaf, got %v, %v", leaf, err)
+	}
+
+	// Without leaf, it is parsed once, also when called concurrently.
+	c.Certificate.Leaf = nil
+	leaves := make([]*x509.Certificate, 10)
+	var wg sync.WaitGroup
+	for i := range leaves {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			leaves[i], err = c.leafCertificate()
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, leaf := range leaves {
+		if leaf == nil || leaf != leaves[0] || !leaf.Equal(testMerchantCert.Leaf) {
+			t.Fatalf("without leaf: expected the same parsed certificate for every call")
+		}
+	}
+
+	// A changed certificate is parsed again.
+	other := testCertificate("Other merchant")
+	c.Certificate = other
+	c.Certificate.Leaf = nil
+	if leaf, err := c.leafCertificate(); err != nil || !leaf.Equal(other.Leaf) {
+		t.Errorf("changed certificate: expected the new leaf, got %v, %v", leaf, err)
+	}
+}
+
+func TestSignedAcquirerError(t *testing.T) {
+	const errorRes = `<AcquirerErrorRes xmlns="http://www.idealdesk.com/ideal/messages/mer-acq/3.3.1" version="3.3.1">
+  <createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>
+  <Error>
+    <errorCode>SO1000</errorCode>
+    <errorMessage>Failure in system</errorMessage>
+    <errorDetail>System generating error: issuer</errorDetail>
+    <consumerMessage>Betalen met iDEAL is nu niet mogelijk.</consumerMessage>
+  </Error>
+</AcquirerErrorRes>`
+	var response string
+	server := newTestServer(t, func(req *etree.Element) string {
+		return response
+	})
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+
+	response = signResponse(testAcquirerCert, errorRes)
+	_, err := c.DirectoryRequest()
+	var acquirerErr *AcquirerError
+	if !errors.As(err, &acquirerErr) || acquirerErr.ErrorCode != "SO1000" {
+		t.Errorf("signed: expected an AcquirerError, got %v", err)
+	}
+
+	// Unsigned and forged error responses are not trusted.
+	for name, msg := range map[string]string{
+		"unsigned": errorRes,
+		"forged":   signResponse(testCertificate("Attacker"), errorRes),
+	} {
+		response = msg
+		_, err := c.DirectoryRequest()
+		if err == nil || errors.As(err, &acquirerErr) {
+			t.Errorf("%s: expected a validation error, got %v", name, err)
+		}
+	}
+
+	// Unless UnsignedErrors is set.
+	c.UnsignedErrors = true
+	response = errorRes
+	if _, err := c.DirectoryRequest(); !errors.As(err, &acquirerErr) {
+		t.Errorf("unsigned with UnsignedErrors: expected an AcquirerError, got %v", err)
+	}
+}
+
+func TestAcquirerErrorIs(t *testing.T) {
+	var errorCode string
+	server := newTestServer(t, func(req *etree.Element) string {
+		return signResponse(testAcquirerCert, `<AcquirerErrorRes xmlns="http://www.betaalvereniging.nl/iDx/messages/Merchant-Acquirer/1.0.0" version="1.0.0" productID="NL:BVN:BankID:1.0">
+  <createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>
+  <Error>
+    <errorCode>`+errorCode+`</errorCode>
+    <errorMessage>Error</errorMessage>
+  </Error>
+</AcquirerErrorRes>`)
+	})
+	c := &IDINClient{CommonClient: newTestClient(server.URL)}
+	c.StatusConsumedCodes = []string{"AP2900"}
+
+	for _, tc := range []struct {
+		errorCode      string
+		clockSkew      bool
+		statusConsumed bool
+	}{
+		{"SO1000", false, false},
+		{"BR1270", true, false},
+		{"AP2900", false, true},
+	} {
+		errorCode = tc.errorCode
+		_, err := c.TransactionStatus("0030000123456789")
+		// The error is still a plain *AcquirerError.
+		if acquirerErr, ok := err.(*AcquirerError); !ok || acquirerErr.ErrorCode != tc.errorCode {
+			t.Errorf("%s: expected an *AcquirerError, got %#v", tc.errorCode, err)
+		}
+		if errors.Is(err, ErrClockSkew) != tc.clockSkew {
+			t.Errorf("%s: expected ErrClockSkew to match: %v", tc.errorCode, tc.clockSkew)
+		}
+		if errors.Is(err, ErrStatusAlreadyConsumed) != tc.statusConsumed {
+			t.Errorf("%s: expected ErrStatusAlreadyConsumed to match: %v", tc.errorCode, tc.statusConsumed)
+		}
+	}
+
+	// Only status requests can be consumed.
+	if _, err := c.DirectoryRequest(); errors.Is(err, ErrStatusAlreadyConsumed) {
+		t.Errorf("directory request: unexpected %v", err)
+	}
+}
+
+func TestRootCAs(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		io.WriteString(w, signResponse(testAcquirerCert, testDirectoryRes))
+	}))
+	defer server.Close()
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	c.RootCAs = x509.NewCertPool()
+	c.RootCAs.AddCert(server.Certificate())
+	if _, err := c.DirectoryRequest(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The HTTP client is kept with the client, and replaced when RootCAs
+	// changes.
+	httpClient := c.httpClient()
+	if c.httpClient() != httpClient {
+		t.Error("expected the HTTP client to be reused")
+	}
+	other := &IDealClient{CommonClient: newTestClient(server.URL)}
+	other.RootCAs = c.RootCAs
+	if other.httpClient() == httpClient {
+		t.Error("expected another client to have its own HTTP client")
+	}
+	c.RootCAs = x509.NewCertPool()
+	if c.httpClient() == httpClient {
+		t.Error("expected a new HTTP client for new RootCAs")
+	}
+	if _, err := c.DirectoryRequest(); err == nil {
+		t.Error("expected an error for a server that is not in RootCAs")
+	}
+}
+
+// Copies of a client don't share their cached state.
+func TestClientCopies(t *testing.T) {
+	requests := 0
+	server := newTestServer(t, func(req *etree.Element) string {
+		requests++
+		return signResponse(testAcquirerCert, testDirectoryRes)
+	})
+	common := newTestClient(server.URL)
+	common.CacheDirectory = true
+	common.getState() // as done by e.g. Validate
+	for i := 0; i < 2; i++ {
+		c := &IDealClient{CommonClient: common}
+		for j := 0; j < 2; j++ {
+			if _, err := c.DirectoryRequest(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if requests != 2 {
+		t.Errorf("expected 1 directory request per copy, got %d", requests)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	server := newTestServer(t, func(req *etree.Element) string {
+		return testIDealTrxRes("0030000123456789")
+	})
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	var requests, responses int
+	c.OnRequest = func(method, url string, body []byte) {
+		requests++
+	}
+	c.OnResponse = func(status int, body []byte) {
+		responses++
+	}
+	hookErr := errors.New("rejected by hook")
+	var validated *etree.Element
+	c.OnValidated = func(root *etree.Element) error {
+		validated = root
+		return hookErr
+	}
+
+	// An error from OnValidated aborts the call.
+	transaction := c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode")
+	if err := transaction.Start(); err != hookErr {
+		t.Errorf("expected the error of the hook, got %v", err)
+	}
+	if transaction.TransactionID() != "" {
+		t.Errorf("transaction was started despite the hook error: %s", transaction.TransactionID())
+	}
+	if validated == nil || validated.Tag != "AcquirerTrxRes" {
+		t.Errorf("expected the response in the hook, got %v", validated)
+	}
+	if requests != 1 || responses != 1 {
+		t.Errorf("expected 1 request and response to be logged, got %d and %d", requests, responses)
+	}
+
+	c.OnValidated = func(root *etree.Element) error {
+		return nil
+	}
+	if err := transaction.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRand(t *testing.T) {
+	c := &IDealClient{CommonClient: newTestClient("https://example.com/ideal")}
+	c.Rand = bytes.NewReader(make([]byte, 1024))
+	if id, err := c.NewSAMLID(); err != nil || id != "_"+strings.Repeat("0", 32) {
+		t.Errorf("unexpected SAML ID: %q, %v", id, err)
+	}
+	if entranceCode, err := c.GenerateEntranceCode(); err != nil || entranceCode != strings.Repeat("0", 40) {
+		t.Errorf("unexpected entrance code: %q, %v", entranceCode, err)
+	}
+
+	// The nonce of encrypted audit records is read from the same source.
+	record := c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode").AuditRecord(nil)
+	data, err := record.MarshalEncrypted(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"encryptedPII":"AAAAAAAAAAAAAAAA`)) {
+		t.Errorf("expected a zero nonce: %s", data)
+	}
+
+	// An error of the source is returned.
+	c.Rand = bytes.NewReader(nil)
+	if _, err := c.NewSAMLID(); err == nil {
+		t.Error("expected an error from NewSAMLID")
+	}
+	if _, err := c.GenerateEntranceCode(); err == nil {
+		t.Error("expected an error from GenerateEntranceCode")
+	}
+	record = c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode").AuditRecord(nil)
+	if _, err := record.MarshalEncrypted(bytes.Repeat([]byte{1}, 32)); err == nil {
+		t.Error("expected an error from MarshalEncrypted")
+	}
+
+	// The default source is crypto/rand.
+	c.Rand = nil
+	id1, err1 := c.NewSAMLID()
+	id2, err2 := c.NewSAMLID()
+	if err1 != nil || err2 != nil || id1 == id2 {
+		t.Errorf("expected two different IDs: %q, %q (%v, %v)", id1, id2, err1, err2)
+	}
+}
@@ -0,0 +1,59 @@
+package idx
+
+import (
+	"errors"
+)
+
+// Default messages to show to the consumer, per language.
+var (
+	consumerErrorMessages = map[string]string{
+		"nl": "Er is een fout opgetreden. Probeer het later nogmaals.",
+		"en": "An error occurred. Please try again later.",
+	}
+	consumerStatusMessages = map[string]map[TransactionStatus]string{
+		"nl": {
+			Success:   "De transactie is gelukt.",
+			Cancelled: "De transactie is geannuleerd.",
+			Expired:   "De transactie is verlopen.",
+			Open:      "De transactie is nog niet afgerond.",
+			Failure:   "De transactie is mislukt.",
+		},
+		"en": {
+			Success:   "The transaction was successful.",
+			Cancelled: "The transaction was cancelled.",
+			Expired:   "The transaction has expired.",
+			Open:      "The transaction has not been completed yet.",
+			Failure:   "The transaction has failed.",
+		},
+	}
+)
+
+// consumerLanguage returns language if it is supported, and "nl" otherwise.
+func consumerLanguage(language string) string {
+	if language == "en" {
+		return "en"
+	}
+	return "nl"
+}
+
+// ConsumerMessageFor returns the message to show to the consumer after an
+// error. It is the ConsumerMessage of an *AcquirerError when present (in the
+// language chosen by the acquirer), and otherwise a generic message in the
+// given language ("nl" or "en", defaulting to "nl").
+func ConsumerMessageFor(err error, language string) string {
+	var acquirerErr *AcquirerError
+	if errors.As(err, &acquirerErr) && acquirerErr.ConsumerMessage != "" {
+		return acquirerErr.ConsumerMessage
+	}
+	return consumerErrorMessages[consumerLanguage(language)]
+}
+
+// ConsumerMessageForStatus returns a message to show to the consumer for the
+// given transaction status, in the given language ("nl" or "en", defaulting to
+// "nl").
+func ConsumerMessageForStatus(status TransactionStatus, language string) string {
+	if message, ok := consumerStatusMessages[consumerLanguage(language)][status]; ok {
+		return message
+	}
+	return consumerErrorMessages[consumerLanguage(language)]
+}
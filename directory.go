@@ -0,0 +1,233 @@
+package idx
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// parseDirectoryRequest parses the Directory element of a DirectoryRes message.
+// It walks the Country and Issuer elements once instead of doing repeated path
+// queries, as directories can be large and are parsed on every refresh.
+//
+// Malformed Issuer elements are skipped. When there are any, the remaining
+// directory is returned together with a *DirectoryParseError.
+func (c *CommonClient) parseDirectoryRequest(msg *etree.Element) (*Directory, error) {
+	directory := &Directory{
+		Issuers: make(map[string][]Issuer),
+		Fetched: time.Now(),
+	}
+	directoryEl := msg.SelectElement("Directory")
+	if directoryEl == nil {
+		// Don't return (and cache) an empty list of banks.
+		return nil, errors.New("idx: missing element in response: Directory")
+	}
+	maxIssuers := c.MaxIssuers
+	if maxIssuers == 0 {
+		maxIssuers = 10000
+	}
+	numIssuers := 0
+	numCountries := 0
+	var parseErrors []error
+	for _, countryEl := range directoryEl.ChildElements() {
+		if countryEl.Tag == "directoryDateTimestamp" {
+			// Left zero when it can't be parsed, as the issuers are still
+			// usable.
+			directory.DirectoryDateTimestamp, _ = time.Parse(time.RFC3339, strings.TrimSpace(countryEl.Text()))
+			continue
+		}
+		if countryEl.Tag != "Country" {
+			continue
+		}
+		numCountries++
+		var countryNames []*etree.Element
+		var issuers []Issuer
+		missingIssuerIDs := 0
+		for _, el := range countryEl.ChildElements() {
+			switch el.Tag {
+			case "countryNames":
+				if strings.TrimSpace(el.Text()) != "" {
+					countryNames = append(countryNames, el)
+				}
+			case "Issuer":
+				numIssuers++
+				if numIssuers > maxIssuers {
+					return nil, errors.New("idx: directory has more than " + strconv.Itoa(maxIssuers) + " issuers")
+				}
+				var issuer Issuer
+				for _, field := range el.ChildElements() {
+					switch field.Tag {
+					case "issuerID":
+						issuer.IssuerID = field.Text()
+					case "issuerName":
+						issuer.IssuerName = field.Text()
+					}
+				}
+				if issuer.IssuerID == "" {
+					missingIssuerIDs++
+					continue
+				}
+				issuers = append(issuers, issuer)
+			}
+		}
+		countryName := c.countryName(countryNames, issuers, numCountries)
+		for i := 0; i < missingIssuerIDs; i++ {
+			parseErrors = append(parseErrors, errors.New("issuer without issuerID in country "+strconv.Quote(countryName)))
+		}
+		directory.Issuers[countryName] = append(directory.Issuers[countryName], issuers...)
+	}
+	if parseErrors != nil {
+		return directory, &DirectoryParseError{Errors: parseErrors}
+	}
+	return directory, nil
+}
+
+// countryName returns the name of a country in the directory, given its
+// non-empty countryNames elements. Some acquirers repeat countryNames per
+// language (with an xml:lang attribute) instead of using a single element with
+// the names separated by "/": the name in the configured language is used
+// then, or else the first name. Countries without a name get a placeholder, so
+// that they aren't merged: the country code in the BIC of their first issuer,
+// or "Country n" for the nth Country element.
+func (c *CommonClient) countryName(names []*etree.Element, issuers []Issuer, n int) string {
+	if len(names) != 0 {
+		language := c.language()
+		for _, el := range names {
+			lang := strings.ToLower(el.SelectAttrValue("xml:lang", el.SelectAttrValue("lang", "")))
+			if lang == language || strings.HasPrefix(lang, language+"-") {
+				return strings.TrimSpace(el.Text())
+			}
+		}
+		return strings.TrimSpace(names[0].Text())
+	}
+	if len(issuers) != 0 && len(issuers[0].IssuerID) >= 6 {
+		return strings.ToUpper(issuers[0].IssuerID[4:6])
+	}
+	return "Country " + strconv.Itoa(n)
+}
+
+// DirectoryParseError is returned by DirectoryRequest, together with the
+// directory, when some of the issuers in the directory were malformed. These
+// issuers are left out of the directory, so that a single broken entry doesn't
+// take down the whole list of banks.
+type DirectoryParseError struct {
+	Errors []error
+}
+
+func (e *DirectoryParseError) Error() string {
+	msg := "idx: skipped " + strconv.Itoa(len(e.Errors)) + " malformed issuer(s) in directory:"
+	for _, err := range e.Errors {
+		msg += " " + err.Error() + ";"
+	}
+	return strings.TrimSuffix(msg, ";")
+}
+
+// The directory listing, as returned from a directory request.
+// It is a map from country name to a list of issuers in that country. The
+// country name is in the official language(s) of the country, separated by "/"
+// (e.g. "België/Belgique"). When the acquirer sends a name per language
+// instead, the one in the language of CommonClient.Languages is used. Issuers
+// of a country without a name are listed under the country code of their BIC
+// (e.g. "BE").
+type Directory struct {
+	Issuers map[string][]Issuer `json:"issuers"`
+	Fetched time.Time           `json:"fetched"` // When the directory was received from the acquirer.
+
+	// When the directory was last changed by the acquirer, zero if unknown.
+	// Useful to see whether the list of issuers changed since the last fetch.
+	DirectoryDateTimestamp time.Time `json:"directoryDateTimestamp"`
+}
+
+// A single issuer (bank), as returned in a directory request.
+type Issuer struct {
+	IssuerID   string `json:"issuerID"`   // BIC
+	IssuerName string `json:"issuerName"` // Human-readable name
+}
+
+// Lookup returns the issuer with the given issuer ID. Issuer IDs are BICs, so
+// they are compared case-insensitively.
+func (d *Directory) Lookup(issuerID string) (issuer Issuer, ok bool) {
+	for _, countryIssuers := range d.Issuers {
+		for _, issuer := range countryIssuers {
+			if strings.EqualFold(issuer.IssuerID, issuerID) {
+				return issuer, true
+			}
+		}
+	}
+	return Issuer{}, false
+}
+
+// ErrStaleDirectory is returned by Directory.MustBeFresherThan when the
+// directory is older than allowed.
+var ErrStaleDirectory = errors.New("idx: directory is stale")
+
+// MustBeFresherThan returns ErrStaleDirectory when the directory was fetched
+// longer than maxAge ago, so you can force a refresh instead of showing a list
+// of banks that may be outdated (banks do get added and removed).
+func (d *Directory) MustBeFresherThan(maxAge time.Duration) error {
+	if time.Since(d.Fetched) > maxAge {
+		return ErrStaleDirectory
+	}
+	return nil
+}
+
+// DirectoryDiff lists the changes between two directories, see Directory.Diff.
+type DirectoryDiff struct {
+	Added   []Issuer       `json:"added"`
+	Removed []Issuer       `json:"removed"`
+	Renamed []IssuerRename `json:"renamed"`
+}
+
+// IssuerRename is an issuer that has a different name in the newer directory.
+type IssuerRename struct {
+	IssuerID string `json:"issuerID"`
+	OldName  string `json:"oldName"`
+	NewName  string `json:"newName"`
+}
+
+// Diff returns the issuers that were added, removed and renamed in the other
+// (newer) directory compared to this one. Issuers are matched by issuer ID, so
+// a bank that changes its name is reported as renamed instead of as removed
+// and added. All lists are sorted by issuer ID. A nil directory (either d or
+// other) is treated as an empty directory, so that the first fetched directory
+// can be compared with the lack of a previous one.
+func (d *Directory) Diff(other *Directory) DirectoryDiff {
+	oldIssuers := d.issuersByID()
+	newIssuers := other.issuersByID()
+	var diff DirectoryDiff
+	for id, issuer := range newIssuers {
+		if oldIssuer, ok := oldIssuers[id]; !ok {
+			diff.Added = append(diff.Added, issuer)
+		} else if oldIssuer.IssuerName != issuer.IssuerName {
+			diff.Renamed = append(diff.Renamed, IssuerRename{id, oldIssuer.IssuerName, issuer.IssuerName})
+		}
+	}
+	for id, issuer := range oldIssuers {
+		if _, ok := newIssuers[id]; !ok {
+			diff.Removed = append(diff.Removed, issuer)
+		}
+	}
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].IssuerID < diff.Added[j].IssuerID })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].IssuerID < diff.Removed[j].IssuerID })
+	sort.Slice(diff.Renamed, func(i, j int) bool { return diff.Renamed[i].IssuerID < diff.Renamed[j].IssuerID })
+	return diff
+}
+
+// issuersByID returns all issuers in the directory, indexed by issuer ID. It
+// returns an empty map for a nil directory.
+func (d *Directory) issuersByID() map[string]Issuer {
+	issuers := make(map[string]Issuer)
+	if d == nil {
+		return issuers
+	}
+	for _, countryIssuers := range d.Issuers {
+		for _, issuer := range countryIssuers {
+			issuers[issuer.IssuerID] = issuer
+		}
+	}
+	return issuers
+}
@@ -0,0 +1,254 @@
+package idx
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/beevik/etree"
+)
+
+const testDirectoryRes = `<?xml version="1.0" encoding="UTF-8"?>
+<DirectoryRes xmlns="http://www.idealdesk.com/ideal/messages/mer-acq/3.3.1" version="3.3.1">
+  <createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>
+  <Acquirer>
+    <acquirerID>0030</acquirerID>
+  </Acquirer>
+  <Directory>
+    <directoryDateTimestamp>2017-01-01T00:00:00.000Z</directoryDateTimestamp>
+    <Country>
+      <countryNames>Nederland</countryNames>
+      <Issuer>
+        <issuerID>ABNANL2A</issuerID>
+        <issuerName>ABN AMRO</issuerName>
+      </Issuer>
+      <Issuer>
+        <issuerID>INGBNL2A</issuerID>
+        <issuerName>ING</issuerName>
+      </Issuer>
+      <Issuer>
+        <issuerID>RABONL2U</issuerID>
+        <issuerName>Rabobank</issuerName>
+      </Issuer>
+    </Country>
+    <Country>
+      <countryNames>België/Belgique</countryNames>
+      <Issuer>
+        <issuerID>KREDBE22</issuerID>
+        <issuerName>KBC</issuerName>
+      </Issuer>
+    </Country>
+  </Directory>
+</DirectoryRes>`
+
+// parseTestDirectory parses a DirectoryRes message with parseDirectoryRequest.
+func parseTestDirectory(t testing.TB, c *CommonClient, msg string) (*Directory, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(msg); err != nil {
+		t.Fatal(err)
+	}
+	return c.parseDirectoryRequest(doc.Root())
+}
+
+func TestParseDirectory(t *testing.T) {
+	directory, err := parseTestDirectory(t, &CommonClient{}, testDirectoryRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(directory.Issuers["Nederland"]); n != 3 {
+		t.Errorf("expected 3 Dutch issuers, got %d", n)
+	}
+	if issuer, ok := directory.Lookup("kredbe22"); !ok || issuer.IssuerName != "KBC" {
+		t.Errorf("could not look up KBC: %v", issuer)
+	}
+	if directory.DirectoryDateTimestamp.IsZero() {
+		t.Error("directoryDateTimestamp was not parsed")
+	}
+}
+
+func TestCountryNames(t *testing.T) {
+	const msg = `<DirectoryRes><Directory>
+  <Country>
+    <Issuer><issuerID>KREDBE22</issuerID><issuerName>KBC</issuerName></Issuer>
+  </Country>
+  <Country>
+    <countryNames> </countryNames>
+    <Issuer><issuerID>X</issuerID><issuerName>Unknown</issuerName></Issuer>
+  </Country>
+  <Country>
+    <countryNames xml:lang="nl">Duitsland</countryNames>
+    <countryNames xml:lang="en">Germany</countryNames>
+    <Issuer><issuerID>DEUTDEFF</issuerID><issuerName>Deutsche Bank</issuerName></Issuer>
+  </Country>
+</Directory></DirectoryRes>`
+	for _, tc := range []struct {
+		languages []string
+		names     []string
+	}{
+		{nil, []string{"BE", "Country 2", "Duitsland"}},
+		{[]string{"en"}, []string{"BE", "Country 2", "Germany"}},
+	} {
+		directory, err := parseTestDirectory(t, &CommonClient{Languages: tc.languages}, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(directory.Issuers) != len(tc.names) {
+			t.Errorf("%v: expected countries %v, got %v", tc.languages, tc.names, directory.Issuers)
+		}
+		for _, name := range tc.names {
+			if len(directory.Issuers[name]) != 1 {
+				t.Errorf("%v: expected 1 issuer in %q, got %v", tc.languages, name, directory.Issuers)
+			}
+		}
+	}
+}
+
+func TestParseDirectoryMissing(t *testing.T) {
+	directory, err := parseTestDirectory(t, &CommonClient{}, `<DirectoryRes><createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp></DirectoryRes>`)
+	if err == nil || directory != nil {
+		t.Errorf("expected an error for a response without Directory, got %v, %v", directory, err)
+	}
+}
+
+// testMalformedDirectoryRes is testDirectoryRes with an issuer (ING) that has
+// no issuerID.
+var testMalformedDirectoryRes = strings.Replace(testDirectoryRes, "<issuerID>INGBNL2A</issuerID>", "", 1)
+
+func TestParseDirectoryMalformedIssuer(t *testing.T) {
+	directory, err := parseTestDirectory(t, &CommonClient{}, testMalformedDirectoryRes)
+	var parseErr *DirectoryParseError
+	if !errors.As(err, &parseErr) || len(parseErr.Errors) != 1 {
+		t.Fatalf("expected a DirectoryParseError with 1 error, got %v", err)
+	}
+	if directory == nil {
+		t.Fatal("expected the other issuers together with the error")
+	}
+	if _, ok := directory.Lookup("ABNANL2A"); !ok {
+		t.Error("expected the other issuers of the country")
+	}
+	if _, ok := directory.Lookup("KREDBE22"); !ok {
+		t.Error("expected the issuers of other countries")
+	}
+	for _, issuer := range directory.Issuers["Nederland"] {
+		if issuer.IssuerID == "" {
+			t.Errorf("malformed issuer was not skipped: %+v", issuer)
+		}
+	}
+}
+
+// A directory with a malformed issuer is cached like any other directory.
+func TestCachePartialDirectory(t *testing.T) {
+	requests := 0
+	server := newTestServer(t, func(req *etree.Element) string {
+		requests++
+		return signResponse(testAcquirerCert, testMalformedDirectoryRes)
+	})
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	c.CacheDirectory = true
+	for i := 0; i < 2; i++ {
+		directory, err := c.DirectoryRequest()
+		var parseErr *DirectoryParseError
+		if !errors.As(err, &parseErr) || directory == nil || len(directory.Issuers["Nederland"]) != 2 {
+			t.Errorf("request %d: expected a partial directory, got %v, %v", i+1, directory, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 directory request, got %d", requests)
+	}
+}
+
+func TestMaxIssuers(t *testing.T) {
+	c := &CommonClient{MaxIssuers: 100}
+	if _, err := parseTestDirectory(t, c, largeTestDirectory(10, 10)); err != nil {
+		t.Errorf("100 issuers: expected no error, got %v", err)
+	}
+	if directory, err := parseTestDirectory(t, c, largeTestDirectory(1, 101)); err == nil || directory != nil {
+		t.Errorf("101 issuers: expected an error, got %v", err)
+	}
+	// The default limit is 10000.
+	if _, err := parseTestDirectory(t, &CommonClient{}, largeTestDirectory(10, 1001)); err == nil {
+		t.Error("10010 issuers: expected an error with the default limit")
+	}
+}
+
+func TestDirectoryDiff(t *testing.T) {
+	old := &Directory{Issuers: map[string][]Issuer{
+		"Nederland": {{"ABNANL2A", "ABN AMRO"}, {"INGBNL2A", "ING"}, {"SNSBNL2A", "SNS Bank"}},
+	}}
+	newer := &Directory{Issuers: map[string][]Issuer{
+		"Nederland": {{"ABNANL2A", "ABN AMRO"}, {"RABONL2U", "Rabobank"}, {"SNSBNL2A", "SNS"}},
+	}}
+	diff := old.Diff(newer)
+	if !reflect.DeepEqual(diff, DirectoryDiff{
+		Added:   []Issuer{{"RABONL2U", "Rabobank"}},
+		Removed: []Issuer{{"INGBNL2A", "ING"}},
+		Renamed: []IssuerRename{{"SNSBNL2A", "SNS Bank", "SNS"}},
+	}) {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+
+	// A nil directory is treated as an empty one.
+	if diff := old.Diff(nil); len(diff.Added) != 0 || len(diff.Removed) != 3 || len(diff.Renamed) != 0 {
+		t.Errorf("diff with nil: %+v", diff)
+	}
+	var empty *Directory
+	if diff := empty.Diff(newer); len(diff.Added) != 3 || len(diff.Removed) != 0 || len(diff.Renamed) != 0 {
+		t.Errorf("diff of nil: %+v", diff)
+	}
+	if diff := empty.Diff(nil); len(diff.Added)+len(diff.Removed)+len(diff.Renamed) != 0 {
+		t.Errorf("diff of nil with nil: %+v", diff)
+	}
+}
+
+func FuzzParseDirectory(f *testing.F) {
+	f.Add([]byte(testDirectoryRes))
+	f.Add([]byte(`<DirectoryRes><Directory><Country><Issuer/></Country></Directory></DirectoryRes>`))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromBytes(msg); err != nil || doc.Root() == nil {
+			return
+		}
+		c := &CommonClient{MaxIssuers: 100}
+		directory, err := c.parseDirectoryRequest(doc.Root())
+		if err == nil && directory == nil {
+			t.Error("no directory and no error")
+		}
+	})
+}
+
+// largeTestDirectory returns a DirectoryRes message with the given number of
+// countries and issuers per country.
+func largeTestDirectory(countries, issuers int) string {
+	var b strings.Builder
+	b.WriteString(`<DirectoryRes xmlns="http://www.idealdesk.com/ideal/messages/mer-acq/3.3.1" version="3.3.1">`)
+	b.WriteString(`<createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>`)
+	b.WriteString(`<Acquirer><acquirerID>0030</acquirerID></Acquirer><Directory>`)
+	b.WriteString(`<directoryDateTimestamp>2017-01-01T00:00:00.000Z</directoryDateTimestamp>`)
+	for i := 0; i < countries; i++ {
+		b.WriteString(`<Country><countryNames>Country ` + strconv.Itoa(i) + `</countryNames>`)
+		for j := 0; j < issuers; j++ {
+			id := strconv.Itoa(i*issuers + j)
+			b.WriteString(`<Issuer><issuerID>BANK` + id + `</issuerID><issuerName>Bank ` + id + `</issuerName></Issuer>`)
+		}
+		b.WriteString(`</Country>`)
+	}
+	b.WriteString(`</Directory></DirectoryRes>`)
+	return b.String()
+}
+
+func BenchmarkParseDirectory(b *testing.B) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(largeTestDirectory(30, 100)); err != nil {
+		b.Fatal(err)
+	}
+	c := &CommonClient{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.parseDirectoryRequest(doc.Root()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package idx
+
+import (
+	"errors"
+	"strings"
+)
+
+// errorCodeInvalidDateTime is the error code for an invalid date or time. The
+// only date in requests is the createDateTimestamp (and the IssueInstant of
+// iDIN requests, which is copied from it).
+const errorCodeInvalidDateTime = "BR1270"
+
+// ErrClockSkew matches (using errors.Is) an *AcquirerError with error code
+// BR1270, which acquirers return when the createDateTimestamp of a request is
+// too far off. This usually means the clock of the server is wrong, so check
+// whether NTP is working. The same error code is used for a timestamp in a
+// format the acquirer doesn't accept, see NumericUTCOffset. As the request
+// was rejected, it can be retried with IDealTransaction.Resubmit after the
+// clock is fixed.
+var ErrClockSkew = errors.New("idx: request rejected because of clock skew")
+
+// Suggested actions for an AcquirerError, see AcquirerError.SuggestedAction.
+const (
+	ActionRetry       = "retry"        // A temporary problem at the acquirer or bank: try again later.
+	ActionReconfigure = "reconfigure"  // The merchant configuration (IDs, certificates) is wrong.
+	ActionFixRequest  = "fix-request"  // The request was invalid, e.g. a field that is too long.
+	ActionShowMessage = "show-message" // Show the ConsumerMessage and let the consumer try again.
+)
+
+// SuggestedAction returns what the merchant should do after this error, as one
+// of the Action* constants. The error response has no element for this, so it
+// is derived from the error code:
+//
+//   - SO (system) errors: ActionRetry.
+//   - SE (security) errors, and AP1000-AP1500 (unknown or inactive merchant,
+//     unknown subID): ActionReconfigure.
+//   - IX (invalid XML) and BR (field format) errors, and AP errors about the
+//     transaction content such as the amount or currency: ActionFixRequest.
+//   - Other errors, like an unknown issuer: ActionShowMessage.
+func (e AcquirerError) SuggestedAction() string {
+	code := e.ErrorCode
+	switch {
+	case strings.HasPrefix(code, "SO"):
+		return ActionRetry
+	case strings.HasPrefix(code, "SE"):
+		return ActionReconfigure
+	case strings.HasPrefix(code, "IX"), strings.HasPrefix(code, "BR"):
+		return ActionFixRequest
+	}
+	switch code {
+	case "AP1000", "AP1100", "AP1300", "AP1500":
+		return ActionReconfigure
+	case "AP2600", "AP2620", "AP2900", "AP2910", "AP2915", "AP2920":
+		return ActionFixRequest
+	}
+	return ActionShowMessage
+}
+
+// ErrorCodeInfo describes an error code that may be returned by an acquirer,
+// see KnownErrorCodes.
+type ErrorCodeInfo struct {
+	Code        string // e.g. "SO1100"
+	Description string // short description from the specification
+	Category    string // "xml", "system", "security", "field" or "application"
+	Retryable   bool   // whether the same request may succeed later
+	Action      string // see AcquirerError.SuggestedAction
+}
+
+// errorCodeTable lists the error codes of the iDeal 3.3.1 specification. iDIN
+// uses the same codes.
+var errorCodeTable = []struct {
+	code, description string
+}{
+	{"IX1000", "Received XML not well-formed"},
+	{"IX1100", "Received XML not valid"},
+	{"IX1200", "Encoding type not UTF-8"},
+	{"IX1300", "XML version number invalid"},
+	{"IX1400", "Unknown message"},
+	{"IX1500", "Mandatory main value missing"},
+	{"IX1600", "Mandatory value missing"},
+	{"SO1000", "Failure in system"},
+	{"SO1100", "Issuer not available"},
+	{"SO1200", "System busy, try again later"},
+	{"SO1400", "Unavailable due to maintenance"},
+	{"SE2000", "Authentication error"},
+	{"SE2100", "Authentication method not supported"},
+	{"SE2700", "Invalid electronic signature"},
+	{"BR1200", "Version number invalid"},
+	{"BR1210", "Value contains non-permitted character"},
+	{"BR1220", "Value too long"},
+	{"BR1230", "Value too short"},
+	{"BR1240", "Value too high"},
+	{"BR1250", "Value too low"},
+	{"BR1260", "Unknown entry in list"},
+	{"BR1270", "Invalid date/time"},
+	{"BR1280", "Invalid URL"},
+	{"AP1000", "Acceptant ID unknown"},
+	{"AP1100", "Merchant ID unknown"},
+	{"AP1200", "Issuer ID unknown"},
+	{"AP1300", "Sub ID unknown"},
+	{"AP1500", "Merchant ID not active"},
+	{"AP2600", "Transaction does not exist"},
+	{"AP2620", "Transaction already submitted"},
+	{"AP2700", "Bank account number not 11-proof"},
+	{"AP2900", "Selected currency not supported"},
+	{"AP2910", "Maximum amount exceeded"},
+	{"AP2915", "Amount too low"},
+	{"AP2920", "Expiration period is not valid"},
+}
+
+// errorCategories maps the prefix of an error code to its category.
+var errorCategories = map[string]string{
+	"IX": "xml",
+	"SO": "system",
+	"SE": "security",
+	"BR": "field",
+	"AP": "application",
+}
+
+// KnownErrorCodes returns all error codes defined in the iDeal 3.3.1
+// specification, with a description, category and the suggested action. Only
+// system (SO) errors are retryable: all other errors need a change in the
+// request, the configuration or the choice of the consumer. Acquirers may
+// return other codes too.
+func KnownErrorCodes() []ErrorCodeInfo {
+	infos := make([]ErrorCodeInfo, len(errorCodeTable))
+	for i, entry := range errorCodeTable {
+		category := errorCategories[entry.code[:2]]
+		infos[i] = ErrorCodeInfo{
+			Code:        entry.code,
+			Description: entry.description,
+			Category:    category,
+			Retryable:   category == "system",
+			Action:      AcquirerError{ErrorCode: entry.code}.SuggestedAction(),
+		}
+	}
+	return infos
+}
@@ -1,13 +1,57 @@
 package idx
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/beevik/etree"
 )
 
 type IDealClient struct {
 	CommonClient
+
+	// RequireConsumerAccount makes TransactionStatus return an error when the
+	// consumerIBAN or consumerBIC is missing from a successful transaction.
+	// Some acquirers omit the BIC for certain account types, so this is off by
+	// default.
+	RequireConsumerAccount bool
+
+	// AllowedCurrencies lists the currencies your acquirer accepts, as ISO
+	// 4217 codes. The directory does not include this information, so it has
+	// to be configured. Defaults to only "EUR" when nil or empty.
+	AllowedCurrencies []string
+
+	// StatusConcurrency is the number of status requests StreamStatus does at
+	// the same time. Acquirers limit how often the status may be requested,
+	// so keep it low. Defaults to 1.
+	StatusConcurrency int
+
+	// DuplicatePurchaseIDWindow, when non-zero, guards against starting two
+	// transactions with the same purchase ID within this duration, for
+	// example when a consumer double-clicks the pay button. Starting a
+	// transaction with the same content (see ContentHash) and entrance code
+	// then returns the transaction ID and URL of the first transaction
+	// instead of creating a new one, after waiting for it when it is still
+	// being started. Starting any other transaction with the same purchase ID
+	// returns a *DuplicateTransactionError. Only transactions of this client
+	// are remembered, and a transaction that could not be started is
+	// forgotten.
+	DuplicatePurchaseIDWindow time.Duration
+
+	// DirectoryInterval is the minimum time between directory requests, used
+	// by HealthCheck and CacheDirectory. Defaults to 24 hours, as the iDeal
+	// specification says the directory should be fetched at most once a day
+	// (and at least once a month).
+	DirectoryInterval time.Duration
 }
 
 // A single iDeal transaction.
@@ -16,17 +60,66 @@ type IDealTransaction struct {
 	msg                     *etree.Element
 	issuerAuthenticationURL string
 	transactionID           string
+	signedRequest           []byte
+	attempted               bool   // whether Start has been called
+	contentHash             string // ContentHash at the first attempt
 }
 
-// The returned transaction status after a status request. Fields besides Status
-// are only set when Status equals Success.
+// The returned transaction status after a status request. The consumer and
+// amount fields are only set when Status equals Success. Optional fields are
+// empty when the acquirer didn't include them.
 type IDealTransactionStatus struct {
-	Status       TransactionStatus
-	ConsumerName string // ConsumerName: the full name of one or even multiple consumers.
-	ConsumerIBAN string
-	ConsumerBIC  string
-	Amount       string // for example, "1.00"
-	Currency     string // for example, "EUR"
+	Status              TransactionStatus
+	StatusDateTimestamp string // When the status last changed, e.g. "2017-01-02T15:04:05.000Z" (optional).
+	AcquirerID          string // Identifies the acquirer (optional).
+	ConsumerName        string // ConsumerName: the full name of one or even multiple consumers.
+	ConsumerIBAN        string
+	ConsumerBIC         string // May be empty for some account types, see IDealClient.RequireConsumerAccount.
+	Amount              string // for example, "1.00"
+	Currency            string // for example, "EUR"
+
+	// RawResponse is the AcquirerStatusRes as it was received, only set when
+	// KeepMessages is set on the client. It is also returned together with the
+	// error for an invalid status.
+	RawResponse []byte
+}
+
+// ParsedAmount returns Amount parsed with ParseAmount, for comparing it exactly
+// with the amount of the transaction. An error is returned when the acquirer
+// returned no amount or a malformed one.
+func (s *IDealTransactionStatus) ParsedAmount() (Amount, error) {
+	return ParseAmount(s.Amount)
+}
+
+// IBANCountry returns the ISO 3166 country code of the consumer IBAN, for
+// example "NL", or an empty string when there is no (valid) IBAN. It can be
+// used to enforce a policy on the country of the paying account.
+func (s *IDealTransactionStatus) IBANCountry() string {
+	iban := strings.TrimSpace(s.ConsumerIBAN)
+	if len(iban) < 2 {
+		return ""
+	}
+	country := strings.ToUpper(iban[:2])
+	if country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+		return ""
+	}
+	return country
+}
+
+// NewIDealClient creates a new iDeal client and checks the configuration using
+// Validate. When the only problem is an incomplete certificate chain, both the
+// client and the *IncompleteChainError are returned, as not all acquirers
+// require the full chain.
+//
+// Creating an IDealClient directly (without this function) is also supported.
+func NewIDealClient(opts ClientOptions) (*IDealClient, error) {
+	common, err := newCommonClient(opts)
+	if err != nil {
+		if _, ok := err.(*IncompleteChainError); !ok {
+			return nil, err
+		}
+	}
+	return &IDealClient{CommonClient: common}, err
 }
 
 func (c *IDealClient) createMessage(tag string) *etree.Element {
@@ -36,35 +129,100 @@ func (c *IDealClient) createMessage(tag string) *etree.Element {
 	return msg
 }
 
-func (c *IDealClient) request(msg string) (*etree.Document, error) {
-	doc, err := c.CommonClient.request(msg)
-	if doc != nil && doc.ChildElements()[0].Tag == "AcquirerErrorRes" {
-		return nil, &AcquirerError{
-			ErrorCode:       doc.FindElement("/AcquirerErrorRes/Error/errorCode").Text(),
-			ErrorMessage:    doc.FindElement("/AcquirerErrorRes/Error/errorMessage").Text(),
-			ErrorDetail:     doc.FindElement("/AcquirerErrorRes/Error/errorDetail").Text(),
-			ConsumerMessage: doc.FindElement("/AcquirerErrorRes/Error/consumerMessage").Text(),
-		}
+func (c *IDealClient) request(ctx context.Context, msg []byte) (*etree.Document, []byte, error) {
+	doc, raw, err := c.CommonClient.request(ctx, msg)
+	if doc != nil && doc.Root().Tag == "AcquirerErrorRes" {
+		return nil, nil, c.acquirerError(doc)
 	}
-	return doc, err
+	return doc, raw, err
 }
 
 // Do a directory request, to get a list of banks.
 //
 // It should be executed somewhere between once a day and once a month, and
 // specifically must not be executed on each request. This means you have to
-// cache the returned list of banks.
+// cache the returned list of banks, for example by setting CacheDirectory.
+//
+// Malformed issuers are left out of the directory, in which case both the
+// directory and a *DirectoryParseError are returned.
 func (c *IDealClient) DirectoryRequest() (*Directory, error) {
+	return c.DirectoryRequestContext(context.Background())
+}
+
+// DirectoryRequestContext is like DirectoryRequest, but the request is aborted
+// when ctx is cancelled.
+func (c *IDealClient) DirectoryRequestContext(ctx context.Context) (*Directory, error) {
+	return c.cachedDirectory(ctx, c.directoryInterval(), c.directoryRequest)
+}
+
+func (c *IDealClient) directoryRequest(ctx context.Context) (*Directory, error) {
 	msg := c.createMessage("DirectoryReq")
-	doc, err := c.request(c.signMessage(msg))
+	signed, err := c.signMessage(msg)
 	if err != nil {
 		return nil, err
 	}
-	response, err := c.validateMessage(doc)
+	doc, _, err := c.request(ctx, signed)
 	if err != nil {
 		return nil, err
 	}
-	return c.parseDirectoryRequest(response), nil
+	response, err := c.validateMessage(doc, "DirectoryRes")
+	if err != nil {
+		return nil, err
+	}
+	return c.parseDirectoryRequest(response)
+}
+
+// A failed health check is retried at most once a minute.
+const healthCheckRetryDelay = time.Minute
+
+// directoryInterval returns DirectoryInterval or its default.
+func (c *IDealClient) directoryInterval() time.Duration {
+	if c.DirectoryInterval == 0 {
+		return 24 * time.Hour
+	}
+	return c.DirectoryInterval
+}
+
+// HealthCheck checks whether the acquirer can be reached and whether the whole
+// request path (TLS, signing, response validation) works, for use in a
+// readiness probe. It does this with a directory request, as that doesn't
+// create a transaction.
+//
+// Directory requests are rate limited by the acquirer, so HealthCheck returns
+// nil without doing a request when a directory was fetched by this client (by
+// DirectoryRequest or HealthCheck) within DirectoryInterval. A failed check
+// returns the same error for a minute before trying again, unless it failed
+// because ctx was done. A directory with malformed issuers (see
+// DirectoryParseError) passes the check.
+func (c *IDealClient) HealthCheck(ctx context.Context) error {
+	state := c.getState()
+	state.mu.Lock()
+	fresh := state.directory != nil && time.Since(state.directory.Fetched) < c.directoryInterval()
+	healthErr := state.healthErr
+	if healthErr != nil && time.Since(state.healthChecked) >= healthCheckRetryDelay {
+		healthErr = nil
+	}
+	state.mu.Unlock()
+	if fresh {
+		return nil
+	}
+	if healthErr != nil {
+		return healthErr
+	}
+	_, err := c.fetchDirectory(ctx, c.directoryRequest)
+	if isDirectoryParseError(err) {
+		// The acquirer could be reached, the directory content is the problem.
+		err = nil
+	}
+	if ctx.Err() != nil {
+		// The caller gave up, which says nothing about the acquirer.
+		return err
+	}
+	state.mu.Lock()
+	state.healthChecked = time.Now()
+	state.healthErr = err
+	state.mu.Unlock()
+	return err
 }
 
 // Request the status of a transaction. Returns an error on network/protocol
@@ -73,23 +231,47 @@ func (c *IDealClient) DirectoryRequest() (*Directory, error) {
 // There are limits on how often you can call this function, see the
 // specification for details ("Collection duty").
 func (c *IDealClient) TransactionStatus(trxid string) (*IDealTransactionStatus, error) {
+	return c.TransactionStatusContext(context.Background(), trxid)
+}
+
+// TransactionStatusContext is like TransactionStatus, but the request is
+// aborted when ctx is cancelled.
+func (c *IDealClient) TransactionStatusContext(ctx context.Context, trxid string) (*IDealTransactionStatus, error) {
 	msg := c.createMessage("AcquirerStatusReq")
 	msg.CreateElement("Transaction").CreateElement("transactionID").SetText(trxid)
-	doc, err := c.request(c.signMessage(msg))
+	signed, err := c.signMessage(msg)
 	if err != nil {
 		return nil, err
 	}
-	response, err := c.validateMessage(doc)
+	doc, raw, err := c.request(ctx, signed)
 	if err != nil {
 		return nil, err
 	}
+	response, err := c.validateMessage(doc, "AcquirerStatusRes")
+	if err != nil {
+		return nil, err
+	}
+	return c.parseTransactionStatus(response, trxid, raw)
+}
 
-	transactionID := response.FindElement("/Transaction/transactionID").Text()
-	if transactionID != trxid {
+// parseTransactionStatus parses the validated AcquirerStatusRes of the given
+// transaction. The raw response is only used for RawResponse.
+func (c *IDealClient) parseTransactionStatus(response *etree.Element, trxid string, raw []byte) (*IDealTransactionStatus, error) {
+	// Collect all fields of the Transaction element in one pass.
+	transactionEl := response.SelectElement("Transaction")
+	if transactionEl == nil {
+		return nil, errors.New("idx: missing element in response: Transaction")
+	}
+	fields := make(map[string]string)
+	for _, el := range transactionEl.ChildElements() {
+		fields[el.Tag] = el.Text()
+	}
+
+	if fields["transactionID"] != trxid {
 		return nil, errors.New("idx: returned transaction ID does not match")
 	}
 
-	statusString := response.FindElement("/Transaction/status").Text()
+	statusString := fields["status"]
 	var status TransactionStatus
 	switch statusString {
 	case "Success":
@@ -106,52 +288,214 @@ func (c *IDealClient) TransactionStatus(trxid string) (*IDealTransactionStatus,
 		status = InvalidStatus
 	}
 
+	var rawResponse []byte
+	if c.KeepMessages {
+		rawResponse = raw
+	}
+
 	if status == InvalidStatus {
 		// Invalid status (not one of the statuses specified in the MIR).
-		return nil, errors.New("ideal: invalid status: " + statusString)
+		// Return the status too, so the RawResponse can be inspected.
+		return &IDealTransactionStatus{Status: status, RawResponse: rawResponse}, errors.New("ideal: invalid status: " + statusString)
 	} else if status == Success {
 		// Valid response, transaction was successful.
+		if c.RequireConsumerAccount && (fields["consumerIBAN"] == "" || fields["consumerBIC"] == "") {
+			return nil, errors.New("idx: consumerIBAN or consumerBIC missing in successful transaction")
+		}
 		return &IDealTransactionStatus{
-			Status:       status,
-			ConsumerName: response.FindElement("/Transaction/consumerName").Text(),
-			ConsumerIBAN: response.FindElement("/Transaction/consumerIBAN").Text(),
-			ConsumerBIC:  response.FindElement("/Transaction/consumerBIC").Text(),
-			Amount:       response.FindElement("/Transaction/amount").Text(),
-			Currency:     response.FindElement("/Transaction/currency").Text(),
+			Status:              status,
+			StatusDateTimestamp: fields["statusDateTimestamp"],
+			AcquirerID:          optionalText(response, "Acquirer/acquirerID"),
+			ConsumerName:        c.normalize(fields["consumerName"]),
+			ConsumerIBAN:        fields["consumerIBAN"],
+			ConsumerBIC:         fields["consumerBIC"],
+			Amount:              fields["amount"],
+			Currency:            fields["currency"],
+			RawResponse:         rawResponse,
 		}, nil
 	} else {
 		// Valid response, but status was not "Success".
 		return &IDealTransactionStatus{
-			Status: status,
+			Status:              status,
+			StatusDateTimestamp: fields["statusDateTimestamp"],
+			AcquirerID:          optionalText(response, "Acquirer/acquirerID"),
+			RawResponse:         rawResponse,
 		}, nil
 	}
+}
 
+// IDealStatusResult is the result of a single status request done by
+// StreamStatus.
+type IDealStatusResult struct {
+	TransactionID string
+	Status        *IDealTransactionStatus // nil when Err is set
+	Err           error
+}
+
+// StreamStatus requests the status of all given transactions and sends the
+// results to out as they complete, for example for a nightly reconciliation of
+// many transactions. Results are not in the same order as trxids. At most
+// StatusConcurrency requests are done at the same time, and rate limited
+// requests are retried after the time the acquirer asked for.
+//
+// StreamStatus blocks until all requests are done or ctx is cancelled, and
+// closes out before returning. When ctx is cancelled, the remaining
+// transactions are skipped.
+func (c *IDealClient) StreamStatus(ctx context.Context, trxids []string, out chan<- IDealStatusResult) {
+	defer close(out)
+	concurrency := c.StatusConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ids := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for trxid := range ids {
+				status, err := c.rateLimitedStatus(ctx, trxid)
+				select {
+				case out <- IDealStatusResult{trxid, status, err}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+feed:
+	for _, trxid := range trxids {
+		select {
+		case ids <- trxid:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ids)
+	wg.Wait()
+}
+
+// rateLimitedStatus requests the status of a transaction, waiting and retrying
+// when the acquirer responds with a *RateLimitError that has a RetryAfter.
+func (c *IDealClient) rateLimitedStatus(ctx context.Context, trxid string) (*IDealTransactionStatus, error) {
+	for {
+		status, err := c.TransactionStatusContext(ctx, trxid)
+		rateErr, ok := err.(*RateLimitError)
+		if !ok || rateErr.RetryAfter == 0 {
+			return status, err
+		}
+		timer := time.NewTimer(rateErr.RetryAfter)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
 }
 
 // Create a transaction object but do not start it.
 //
 // The issuer is the bank ID selected by the consumer, purchaseID is an unique
 // number for this transaction in your system and will appear in the consumer's
-// bank notes, description is the text to show in the client's bank notes, and
-// entranceCode is a session token you can use to resume the (possibly expired)
-// session when the consumer returns to your website.
+// bank notes (it is sent exactly as given, see NormalizePurchaseID),
+// description is the text to show in the client's bank notes, and entranceCode
+// is a session token you can use to resume the (possibly expired) session when
+// the consumer returns to your website.
+//
+// Neither the iDeal 3.3.1 nor the iDIN AcquirerTrxReq schema has elements for
+// consumer metadata like the IP address or a device fingerprint, so there is no
+// way to pass these to the acquirer for fraud scoring. There is no free-form
+// merchant reference either: the status response only contains the
+// transaction ID, so store your own reference together with the transaction
+// ID after Start. The entranceCode is passed back in the return URL (as the
+// "ec" parameter), but not in the status response.
 func (c *IDealClient) NewTransaction(issuer, purchaseID, amount, description, entranceCode string) *IDealTransaction {
 	msg := c.createMessage("AcquirerTrxReq")
-	merchantEl := msg.FindElement("/Merchant")
-	merchantEl.CreateElement("merchantReturnURL").SetText(c.ReturnURL)
-	issuerEl := msg.CreateElement("Issuer")
-	issuerEl.CreateElement("issuerID").SetText(issuer)
-	msg.InsertChild(merchantEl, issuerEl) // order matters: Issuer must occur before Merchant
-	transaction := msg.CreateElement("Transaction")
+	transaction := c.createTransaction(msg, issuer, entranceCode)
 	transaction.CreateElement("purchaseID").SetText(purchaseID)
 	transaction.CreateElement("amount").SetText(amount)
 	transaction.CreateElement("currency").SetText("EUR")
-	transaction.CreateElement("language").SetText("nl")
 	transaction.CreateElement("description").SetText(description)
-	transaction.CreateElement("entranceCode").SetText(entranceCode)
 	return &IDealTransaction{client: c, msg: msg}
 }
 
+// SetLanguage overrides the language of the bank pages for this transaction,
+// instead of using CommonClient.Languages. It returns an error when the
+// language is not in SupportedLanguages. It must be called before Start.
+func (t *IDealTransaction) SetLanguage(language string) error {
+	return setLanguage(t.msg, language)
+}
+
+// SetExpirationPeriod sets how long the consumer has to complete the
+// transaction, instead of the default of the bank. The iDeal specification
+// allows 1 minute up to 1 hour: other durations return an error. Precision
+// beyond seconds is ignored. It must be called before Start.
+func (t *IDealTransaction) SetExpirationPeriod(d time.Duration) error {
+	if d < time.Minute || d > time.Hour {
+		return errors.New("idx: expiration period must be between 1 minute and 1 hour, got " + d.String())
+	}
+	transaction := t.msg.SelectElement("Transaction")
+	el := transaction.SelectElement("expirationPeriod")
+	if el == nil {
+		el = transaction.CreateElement("expirationPeriod")
+	}
+	el.SetText(isoDuration(d))
+	return nil
+}
+
+// isoDuration formats a duration of at most an hour in ISO 8601 format, for
+// example "PT15M" or "PT1M30S".
+func isoDuration(d time.Duration) string {
+	if d == time.Hour {
+		return "PT1H"
+	}
+	s := "PT"
+	if minutes := int(d / time.Minute); minutes != 0 {
+		s += strconv.Itoa(minutes) + "M"
+	}
+	if seconds := int(d % time.Minute / time.Second); seconds != 0 {
+		s += strconv.Itoa(seconds) + "S"
+	}
+	return s
+}
+
+// SetCurrency sets the currency of the transaction as an ISO 4217 code, which
+// is "EUR" by default (also when currency is empty). The currency must be in
+// IDealClient.AllowedCurrencies. It must be called before Start.
+func (t *IDealTransaction) SetCurrency(currency string) {
+	if currency == "" {
+		currency = "EUR"
+	}
+	t.msg.FindElement("Transaction/currency").SetText(currency)
+}
+
+// Validate checks the transaction before it is sent to the acquirer, so that
+// it can't be rejected after the consumer was already sent to the bank. It is
+// called by Start, but can also be called right after NewTransaction.
+func (t *IDealTransaction) Validate() error {
+	if err := ValidateEntranceCode(optionalText(t.msg, "Transaction/entranceCode")); err != nil {
+		return err
+	}
+	if err := ValidatePurchaseID(optionalText(t.msg, "Transaction/purchaseID")); err != nil {
+		return err
+	}
+	if err := ValidateAmount(optionalText(t.msg, "Transaction/amount")); err != nil {
+		return err
+	}
+	currency := optionalText(t.msg, "Transaction/currency")
+	allowed := t.client.AllowedCurrencies
+	if len(allowed) == 0 {
+		allowed = []string{"EUR"}
+	}
+	for _, c := range allowed {
+		if currency == c {
+			return nil
+		}
+	}
+	return errors.New("idx: currency not accepted by acquirer: " + currency)
+}
+
 // Start a transaction.
 //
 // Note that you must save the transaction ID upon creation, so that it can be
@@ -160,25 +504,166 @@ func (c *IDealClient) NewTransaction(issuer, purchaseID, amount, description, en
 // was completed (even when the consumer doesn't return to your website after
 // completion), see the documentation for details.
 func (t *IDealTransaction) Start() error {
+	return t.StartContext(context.Background())
+}
+
+// Resubmit starts the transaction again after Start (or an earlier Resubmit)
+// failed, for example because of a transient error or because the acquirer
+// rejected the timestamp due to clock skew. The message is signed again with a
+// new timestamp, but otherwise has the same content.
+//
+// To avoid creating duplicate transactions, it returns an error when the
+// transaction was already started successfully or when its content (see
+// ContentHash) changed since the first attempt. Note that when the first
+// attempt failed because of a network error, the acquirer may still have
+// created the transaction.
+func (t *IDealTransaction) Resubmit(ctx context.Context) error {
+	if !t.attempted {
+		return errors.New("idx: cannot resubmit a transaction that was not started")
+	}
+	if t.transactionID != "" {
+		return errors.New("idx: cannot resubmit a transaction that was started successfully")
+	}
+	if t.ContentHash() != t.contentHash {
+		return errors.New("idx: cannot resubmit a transaction with different content")
+	}
+	t.msg.SelectElement("createDateTimestamp").SetText(t.client.timestamp(time.Now()))
+	return t.StartContext(ctx)
+}
+
+// StartContext is like Start, but the request is aborted when ctx is
+// cancelled.
+func (t *IDealTransaction) StartContext(ctx context.Context) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	if !t.attempted {
+		t.attempted = true
+		t.contentHash = t.ContentHash()
+	}
+	if t.client.DuplicatePurchaseIDWindow != 0 {
+		// Reserve the purchase ID before doing the request, so that a
+		// concurrent start with the same purchase ID waits for this one.
+		purchaseID := optionalText(t.msg, "Transaction/purchaseID")
+		reservation := &startedTransaction{
+			started:      time.Now(),
+			contentHash:  t.contentHash,
+			entranceCode: optionalText(t.msg, "Transaction/entranceCode"),
+			done:         make(chan struct{}),
+		}
+		for {
+			previous, reserved := t.client.reserveTransaction(purchaseID, reservation)
+			if reserved {
+				break
+			}
+			select {
+			case <-previous.done:
+			case <-ctx.Done():
+				return timeoutError(ctx.Err())
+			}
+			if previous.transactionID == "" {
+				// The previous transaction could not be started and its
+				// reservation was released, so try again.
+				continue
+			}
+			if previous.contentHash != reservation.contentHash || previous.entranceCode != reservation.entranceCode {
+				return &DuplicateTransactionError{PurchaseID: purchaseID, TransactionID: previous.transactionID}
+			}
+			t.issuerAuthenticationURL = previous.issuerAuthenticationURL
+			t.transactionID = previous.transactionID
+			return nil
+		}
+		defer func() {
+			if t.transactionID == "" {
+				t.client.releaseTransaction(purchaseID, reservation)
+			}
+			reservation.issuerAuthenticationURL = t.issuerAuthenticationURL
+			reservation.transactionID = t.transactionID
+			close(reservation.done)
+		}()
+	}
+
 	// create a signed message and do a request
-	doc, err := t.client.request(t.client.signMessage(t.msg))
+	signed, err := t.client.signMessage(t.msg)
+	if err != nil {
+		return err
+	}
+	if t.client.KeepMessages {
+		t.signedRequest = signed
+	}
+	doc, _, err := t.client.request(ctx, signed)
 	if err != nil {
 		return err
 	}
 
 	// validate the response message
-	response, err := t.client.validateMessage(doc)
+	response, err := t.client.validateMessage(doc, "AcquirerTrxRes")
 	if err != nil {
 		return err
 	}
 
 	// extract the transaction ID and the URL to redirect to
-	t.issuerAuthenticationURL = response.FindElement("/Issuer/issuerAuthenticationURL").Text()
-	t.transactionID = response.FindElement("/Transaction/transactionID").Text()
+	issuerAuthenticationURL, err := findText(response, "/Issuer/issuerAuthenticationURL")
+	if err != nil {
+		return err
+	}
+	transactionID, err := findText(response, "/Transaction/transactionID")
+	if err != nil {
+		return err
+	}
+	t.issuerAuthenticationURL = issuerAuthenticationURL
+	t.transactionID = transactionID
 
 	return nil
 }
 
+// DuplicateTransactionError is returned when starting an iDeal transaction
+// with a purchase ID that was used by another transaction within
+// IDealClient.DuplicatePurchaseIDWindow: one with different content, or with
+// a different entrance code and so for another session of the consumer.
+type DuplicateTransactionError struct {
+	PurchaseID    string
+	TransactionID string // The transaction that was started first.
+}
+
+func (e *DuplicateTransactionError) Error() string {
+	return "idx: purchaseID " + e.PurchaseID + " was used recently by transaction " + e.TransactionID
+}
+
+// reserveTransaction reserves the purchase ID for a transaction that is about
+// to be started. When the purchase ID was already reserved within
+// DuplicatePurchaseIDWindow, that reservation is returned instead. Expired
+// reservations are forgotten.
+func (c *IDealClient) reserveTransaction(purchaseID string, reservation *startedTransaction) (previous *startedTransaction, reserved bool) {
+	state := c.getState()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for id, previous := range state.startedTransactions {
+		if time.Since(previous.started) > c.DuplicatePurchaseIDWindow {
+			delete(state.startedTransactions, id)
+		}
+	}
+	if previous, ok := state.startedTransactions[purchaseID]; ok {
+		return previous, false
+	}
+	if state.startedTransactions == nil {
+		state.startedTransactions = make(map[string]*startedTransaction)
+	}
+	state.startedTransactions[purchaseID] = reservation
+	return reservation, true
+}
+
+// releaseTransaction forgets the reservation of a purchase ID when the
+// transaction could not be started, so that it can be started again.
+func (c *IDealClient) releaseTransaction(purchaseID string, reservation *startedTransaction) {
+	state := c.getState()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.startedTransactions[purchaseID] == reservation {
+		delete(state.startedTransactions, purchaseID)
+	}
+}
+
 // Return the URL to redirect the user to to start authentication.
 func (t *IDealTransaction) IssuerAuthenticationURL() string {
 	return t.issuerAuthenticationURL
@@ -188,3 +673,80 @@ func (t *IDealTransaction) IssuerAuthenticationURL() string {
 func (t *IDealTransaction) TransactionID() string {
 	return t.transactionID
 }
+
+// VerifyReturn checks the URL the consumer returned on (at ReturnURL) after
+// paying: the trxid parameter must be the ID of this transaction and the ec
+// parameter its entranceCode. This prevents a consumer from continuing the
+// session of a different transaction. Note that it doesn't tell whether the
+// payment succeeded: use TransactionStatus for that.
+func (t *IDealTransaction) VerifyReturn(u *url.URL) error {
+	if t.transactionID == "" {
+		return errors.New("idx: transaction was not started")
+	}
+	query := u.Query()
+	if trxid := query.Get("trxid"); trxid != t.transactionID {
+		return errors.New("idx: returned trxid " + strconv.Quote(trxid) + " does not match transaction " + t.transactionID)
+	}
+	entranceCode := optionalText(t.msg, "Transaction/entranceCode")
+	if subtle.ConstantTimeCompare([]byte(query.Get("ec")), []byte(entranceCode)) != 1 {
+		return errors.New("idx: returned ec does not match the entranceCode of the transaction")
+	}
+	return nil
+}
+
+// IDealTransactionRequest is a read-only view of the fields of a transaction
+// request, see IDealTransaction.Request.
+type IDealTransactionRequest struct {
+	IssuerID     string
+	PurchaseID   string
+	Amount       string
+	Currency     string
+	Description  string
+	EntranceCode string
+}
+
+// Request returns the fields of the transaction as they will be sent to the
+// acquirer. Changing the returned value does not affect the transaction.
+func (t *IDealTransaction) Request() IDealTransactionRequest {
+	return IDealTransactionRequest{
+		IssuerID:     optionalText(t.msg, "Issuer/issuerID"),
+		PurchaseID:   optionalText(t.msg, "Transaction/purchaseID"),
+		Amount:       optionalText(t.msg, "Transaction/amount"),
+		Currency:     optionalText(t.msg, "Transaction/currency"),
+		Description:  optionalText(t.msg, "Transaction/description"),
+		EntranceCode: optionalText(t.msg, "Transaction/entranceCode"),
+	}
+}
+
+// ContentHash returns a hash of the content of the transaction: the merchant,
+// issuer, purchase ID, amount, currency and description. It deliberately
+// excludes the timestamp (which changes on every attempt) and the entrance
+// code (a session token), so it stays the same when the same transaction is
+// created again. Use it as an idempotency key to avoid charging a consumer
+// twice when retrying.
+func (t *IDealTransaction) ContentHash() string {
+	hash := sha256.New()
+	for _, path := range []string{
+		"Merchant/merchantID",
+		"Merchant/subID",
+		"Issuer/issuerID",
+		"Transaction/purchaseID",
+		"Transaction/amount",
+		"Transaction/currency",
+		"Transaction/description",
+	} {
+		// Prefix each value with its length so that values can't run into
+		// each other.
+		value := optionalText(t.msg, path)
+		io.WriteString(hash, strconv.Itoa(len(value))+":"+value)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Return the signed request as it was sent by Start, or nil if KeepMessages
+// is not set on the client. Useful to find out why the acquirer rejected a
+// transaction: signing the message again would result in a different
+// timestamp.
+func (t *IDealTransaction) SignedRequest() []byte {
+	return t.signedRequest
+}
@@ -0,0 +1,495 @@
+package idx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+const testIDealStatusRes = `<?xml version="1.0" encoding="UTF-8"?>
+<AcquirerStatusRes xmlns="http://www.idealdesk.com/ideal/messages/mer-acq/3.3.1" version="3.3.1">
+  <createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>
+  <Acquirer>
+    <acquirerID>0030</acquirerID>
+  </Acquirer>
+  <Transaction>
+    <transactionID>0030000123456789</transactionID>
+    <status>Success</status>
+    <statusDateTimestamp>2017-01-02T15:04:00.000Z</statusDateTimestamp>
+    <consumerName>J. Jansen</consumerName>
+    <consumerIBAN>NL44RABO0123456789</consumerIBAN>
+    <consumerBIC>RABONL2U</consumerBIC>
+    <amount>1.00</amount>
+    <currency>EUR</currency>
+  </Transaction>
+</AcquirerStatusRes>`
+
+// parseTestIDealStatus parses an AcquirerStatusRes message of transaction
+// 0030000123456789 with parseTransactionStatus.
+func parseTestIDealStatus(t testing.TB, c *IDealClient, msg string) (*IDealTransactionStatus, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(msg); err != nil {
+		t.Fatal(err)
+	}
+	return c.parseTransactionStatus(doc.Root(), "0030000123456789", []byte(msg))
+}
+
+func TestIDealTransactionStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		msg    string
+		status IDealTransactionStatus
+	}{
+		{"complete", testIDealStatusRes, IDealTransactionStatus{
+			Status:              Success,
+			StatusDateTimestamp: "2017-01-02T15:04:00.000Z",
+			AcquirerID:          "0030",
+			ConsumerName:        "J. Jansen",
+			ConsumerIBAN:        "NL44RABO0123456789",
+			ConsumerBIC:         "RABONL2U",
+			Amount:              "1.00",
+			Currency:            "EUR",
+		}},
+		{"optional omitted", `<AcquirerStatusRes><Transaction><transactionID>0030000123456789</transactionID><status>Success</status><consumerIBAN>NL44RABO0123456789</consumerIBAN><amount>1.00</amount><currency>EUR</currency></Transaction></AcquirerStatusRes>`, IDealTransactionStatus{
+			Status:       Success,
+			ConsumerIBAN: "NL44RABO0123456789",
+			Amount:       "1.00",
+			Currency:     "EUR",
+		}},
+		{"not successful", `<AcquirerStatusRes><Acquirer><acquirerID>0030</acquirerID></Acquirer><Transaction><transactionID>0030000123456789</transactionID><status>Cancelled</status><statusDateTimestamp>2017-01-02T15:04:00.000Z</statusDateTimestamp><consumerName>J. Jansen</consumerName></Transaction></AcquirerStatusRes>`, IDealTransactionStatus{
+			Status:              Cancelled,
+			StatusDateTimestamp: "2017-01-02T15:04:00.000Z",
+			AcquirerID:          "0030",
+		}},
+	} {
+		status, err := parseTestIDealStatus(t, &IDealClient{}, tc.msg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*status, tc.status) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.status, *status)
+		}
+	}
+}
+
+func TestIBANCountry(t *testing.T) {
+	for iban, country := range map[string]string{
+		"NL44RABO0123456789":     "NL",
+		"BE68539007547034":       "BE",
+		"DE89370400440532013000": "DE",
+		"nl44rabo0123456789":     "NL",
+		" NL44RABO0123456789":    "NL",
+		"N":                      "",
+		"":                       "",
+		"4400RABO0123456789":     "",
+	} {
+		status := &IDealTransactionStatus{ConsumerIBAN: iban}
+		if got := status.IBANCountry(); got != country {
+			t.Errorf("%q: expected %q, got %q", iban, country, got)
+		}
+	}
+}
+
+func FuzzIDealStatus(f *testing.F) {
+	f.Add([]byte(testIDealStatusRes))
+	f.Add([]byte(`<AcquirerStatusRes><Transaction><transactionID>0030000123456789</transactionID><status>Open</status></Transaction></AcquirerStatusRes>`))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromBytes(msg); err != nil || doc.Root() == nil {
+			return
+		}
+		c := &IDealClient{RequireConsumerAccount: true}
+		status, err := c.parseTransactionStatus(doc.Root(), "0030000123456789", msg)
+		if err == nil && status == nil {
+			t.Error("no status and no error")
+		}
+	})
+}
+
+// Status requests are retried after the Retry-After of a rate limited request.
+func TestRateLimitedStatus(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, signResponse(testAcquirerCert, testIDealStatusRes))
+	}))
+	defer server.Close()
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	start := time.Now()
+	status, err := c.rateLimitedStatus(context.Background(), "0030000123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != Success || requests != 2 {
+		t.Errorf("expected a successful status after 2 requests, got %v after %d", status.Status, requests)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, before Retry-After", elapsed)
+	}
+}
+
+func TestOmitLanguage(t *testing.T) {
+	c := &IDealClient{CommonClient: newTestClient("https://example.com/ideal")}
+	transaction := c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode")
+	if language := optionalText(transaction.msg, "Transaction/language"); language != "nl" {
+		t.Errorf("expected language nl by default, got %q", language)
+	}
+
+	c.OmitLanguage = true
+	transaction = c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode")
+	if transaction.msg.FindElement("Transaction/language") != nil {
+		t.Error("expected no language element with OmitLanguage")
+	}
+
+	// An explicitly set language is always sent.
+	if err := transaction.SetLanguage("en"); err != nil {
+		t.Fatal(err)
+	}
+	if language := optionalText(transaction.msg, "Transaction/language"); language != "en" {
+		t.Errorf("expected language en after SetLanguage, got %q", language)
+	}
+}
+
+func TestAllowedCurrencies(t *testing.T) {
+	for _, tc := range []struct {
+		allowed  []string
+		currency string
+		ok       bool
+	}{
+		{nil, "", true},
+		{nil, "EUR", true},
+		{nil, "USD", false},
+		{[]string{}, "EUR", true},
+		{[]string{}, "USD", false},
+		{[]string{"EUR", "USD"}, "USD", true},
+		{[]string{"USD"}, "EUR", false},
+	} {
+		c := &IDealClient{CommonClient: newTestClient("https://example.com/ideal"), AllowedCurrencies: tc.allowed}
+		transaction := c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode")
+		transaction.SetCurrency(tc.currency)
+		if err := transaction.Validate(); (err == nil) != tc.ok {
+			t.Errorf("AllowedCurrencies %#v, currency %q: unexpected result %v", tc.allowed, tc.currency, err)
+		}
+	}
+}
+
+func TestIssuerIDCase(t *testing.T) {
+	c := &IDealClient{CommonClient: newTestClient("https://example.com/ideal")}
+	transaction := c.NewTransaction("RaboNL2u", "purchase1", "1.00", "description", "entranceCode")
+	if issuerID := optionalText(transaction.msg, "Issuer/issuerID"); issuerID != "RABONL2U" {
+		t.Errorf("expected issuerID RABONL2U, got %s", issuerID)
+	}
+	if issuerID := transaction.Request().IssuerID; issuerID != "RABONL2U" {
+		t.Errorf("expected issuerID RABONL2U in the request, got %s", issuerID)
+	}
+	idin := &IDINClient{CommonClient: newTestClient("https://example.com/idin")}
+	if issuerID := optionalText(idin.NewTransaction("ingbnl2a", "entranceCode", "_1", IDINServiceIDName).msg, "Issuer/issuerID"); issuerID != "INGBNL2A" {
+		t.Errorf("iDIN: expected issuerID INGBNL2A, got %s", issuerID)
+	}
+
+	c.KeepIssuerIDCase = true
+	transaction = c.NewTransaction("RaboNL2u", "purchase1", "1.00", "description", "entranceCode")
+	if issuerID := optionalText(transaction.msg, "Issuer/issuerID"); issuerID != "RaboNL2u" {
+		t.Errorf("with KeepIssuerIDCase: expected issuerID RaboNL2u, got %s", issuerID)
+	}
+}
+
+// testIDealTrxRes returns an iDeal AcquirerTrxRes for the given transaction.
+func testIDealTrxRes(transactionID string) string {
+	return signResponse(testAcquirerCert, `<AcquirerTrxRes xmlns="http://www.idealdesk.com/ideal/messages/mer-acq/3.3.1" version="3.3.1">
+  <createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>
+  <Acquirer>
+    <acquirerID>0030</acquirerID>
+  </Acquirer>
+  <Issuer>
+    <issuerAuthenticationURL>https://bank.example.com/ideal?trxid=`+transactionID+`</issuerAuthenticationURL>
+  </Issuer>
+  <Transaction>
+    <transactionID>`+transactionID+`</transactionID>
+    <transactionCreateDateTimestamp>2017-01-02T15:04:05.000Z</transactionCreateDateTimestamp>
+    <purchaseID>purchase1</purchaseID>
+  </Transaction>
+</AcquirerTrxRes>`)
+}
+
+// A slow directory request must not block other requests, and callers waiting
+// for it must be able to give up.
+func TestSlowDirectoryRequest(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	directoryRequests := 0
+	server := newTestServer(t, func(req *etree.Element) string {
+		if req.Tag == "AcquirerTrxReq" {
+			return testIDealTrxRes("0030000123456789")
+		}
+		mu.Lock()
+		directoryRequests++
+		if directoryRequests == 1 {
+			close(started)
+		}
+		mu.Unlock()
+		<-release
+		return signResponse(testAcquirerCert, testDirectoryRes)
+	})
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	c.DuplicatePurchaseIDWindow = time.Hour
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.DirectoryRequest(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	transaction := c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode")
+	if err := transaction.StartContext(ctx); err != nil {
+		t.Errorf("start during directory request: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.DirectoryRequestContext(ctx); !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting for directory request: expected ErrTimeout, got %v", err)
+	}
+	if err := c.HealthCheck(ctx); !errors.Is(err, ErrTimeout) {
+		t.Errorf("health check during directory request: expected ErrTimeout, got %v", err)
+	}
+
+	// By now, the other DirectoryRequest is waiting for the first.
+	close(release)
+	wg.Wait()
+	if directoryRequests != 1 {
+		t.Errorf("expected concurrent callers to share 1 directory request, got %d", directoryRequests)
+	}
+	if err := c.HealthCheck(context.Background()); err != nil {
+		t.Errorf("health check after directory request: %v", err)
+	}
+}
+
+func TestDuplicatePurchaseID(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	close(release)
+	server := newTestServer(t, func(req *etree.Element) string {
+		mu.Lock()
+		requests++
+		transactionID := "003000012345678" + strconv.Itoa(requests)
+		wait := release
+		mu.Unlock()
+		started <- struct{}{}
+		<-wait
+		if optionalText(req, "Transaction/description") == "fail" {
+			return "not a message"
+		}
+		return testIDealTrxRes(transactionID)
+	})
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	c.DuplicatePurchaseIDWindow = time.Hour
+	start := func(description, entranceCode string) (*IDealTransaction, error) {
+		transaction := c.NewTransaction("RABONL2U", "purchase1", "1.00", description, entranceCode)
+		err := transaction.Start()
+		return transaction, err
+	}
+
+	// A transaction that could not be started is forgotten.
+	if _, err := start("fail", "entranceCode"); err == nil {
+		t.Fatal("expected an error")
+	}
+	<-started
+	first, err := start("description", "entranceCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if first.TransactionID() != "0030000123456782" {
+		t.Fatalf("unexpected transaction ID: %s", first.TransactionID())
+	}
+
+	// The same transaction is started only once.
+	second, err := start("description", "entranceCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.TransactionID() != first.TransactionID() || second.IssuerAuthenticationURL() != first.IssuerAuthenticationURL() {
+		t.Errorf("expected the first transaction, got %s", second.TransactionID())
+	}
+
+	// Another transaction, or the same for another consumer session, is not.
+	for _, tc := range [][2]string{{"other", "entranceCode"}, {"description", "otherEntranceCode"}} {
+		_, err := start(tc[0], tc[1])
+		var duplicateErr *DuplicateTransactionError
+		if !errors.As(err, &duplicateErr) || duplicateErr.TransactionID != first.TransactionID() {
+			t.Errorf("%v: expected a DuplicateTransactionError for %s, got %v", tc, first.TransactionID(), err)
+		}
+	}
+
+	// Concurrent starts, like a double-click, share a single request.
+	mu.Lock()
+	release = make(chan struct{})
+	mu.Unlock()
+	var wg sync.WaitGroup
+	transactionIDs := make([]string, 2)
+	for i := range transactionIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			transaction := c.NewTransaction("RABONL2U", "purchase2", "1.00", "description", "entranceCode")
+			if err := transaction.Start(); err != nil {
+				t.Error(err)
+			}
+			transactionIDs[i] = transaction.TransactionID()
+		}(i)
+	}
+	<-started
+	time.Sleep(50 * time.Millisecond) // let the other start wait for the first
+	close(release)
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 3 || transactionIDs[0] != transactionIDs[1] {
+		t.Errorf("expected 1 request for concurrent starts, got %d requests for %v", requests-2, transactionIDs)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	var delay time.Duration
+	server := newTestServer(t, func(req *etree.Element) string {
+		mu.Lock()
+		requests++
+		d := delay
+		mu.Unlock()
+		time.Sleep(d)
+		return signResponse(testAcquirerCert, testMalformedDirectoryRes)
+	})
+
+	// A malformed issuer is not a health problem, and the directory is fresh
+	// afterwards.
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	for i := 0; i < 2; i++ {
+		if err := c.HealthCheck(context.Background()); err != nil {
+			t.Errorf("check %d: %v", i+1, err)
+		}
+	}
+	mu.Lock()
+	if requests != 1 {
+		t.Errorf("expected 1 directory request, got %d", requests)
+	}
+	delay = time.Second
+	mu.Unlock()
+
+	// A check that is aborted by the caller is not remembered.
+	c = &IDealClient{CommonClient: newTestClient(server.URL)}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.HealthCheck(ctx); err == nil {
+		t.Error("expected an error for an aborted check")
+	}
+	mu.Lock()
+	delay = 0
+	mu.Unlock()
+	if err := c.HealthCheck(context.Background()); err != nil {
+		t.Errorf("check after an aborted check: %v", err)
+	}
+}
+
+func TestVerifyReturn(t *testing.T) {
+	server := newTestServer(t, func(req *etree.Element) string {
+		return testIDealTrxRes("0030000123456789")
+	})
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	transaction := c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode")
+	if err := transaction.VerifyReturn(&url.URL{}); err == nil {
+		t.Error("expected an error for a transaction that was not started")
+	}
+	if err := transaction.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		query string
+		ok    bool
+	}{
+		{"trxid=0030000123456789&ec=entranceCode", true},
+		{"trxid=0030000123456789&ec=otherEntranceCode", false},
+		{"trxid=0030000123456789", false},
+		{"trxid=0030000987654321&ec=entranceCode", false},
+		{"ec=entranceCode", false},
+	} {
+		u, err := url.Parse("https://example.com/return?" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := transaction.VerifyReturn(u); (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected result %v", tc.query, err)
+		}
+	}
+}
+
+// Purchase IDs are opaque strings: leading zeros are kept everywhere.
+func TestPurchaseIDLeadingZeros(t *testing.T) {
+	purchaseID, err := NormalizePurchaseID(" 000123 ")
+	if err != nil || purchaseID != "000123" {
+		t.Fatalf("expected 000123, got %q, %v", purchaseID, err)
+	}
+	server := newTestServer(t, func(req *etree.Element) string {
+		if req.Tag == "AcquirerStatusReq" {
+			return signResponse(testAcquirerCert, testIDealStatusRes)
+		}
+		if sent := optionalText(req, "Transaction/purchaseID"); sent != "000123" {
+			t.Errorf("expected purchaseID 000123 in request, got %s", sent)
+		}
+		return testIDealTrxRes("0030000123456789")
+	})
+	c := &IDealClient{CommonClient: newTestClient(server.URL)}
+	transaction := c.NewTransaction("RABONL2U", purchaseID, "1.00", "description", "entranceCode")
+	if err := transaction.Start(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := c.TransactionStatus(transaction.TransactionID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := transaction.Request().PurchaseID; got != "000123" {
+		t.Errorf("expected purchaseID 000123 in Request, got %s", got)
+	}
+	data, err := transaction.AuditRecord(status).MarshalRedacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record AuditRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.PurchaseID != "000123" || record.Status != "Success" {
+		t.Errorf("expected purchaseID 000123 in audit record, got %+v", record)
+	}
+}
@@ -1,9 +1,13 @@
 package idx
 
 import (
+	"context"
 	"crypto/rsa"
 	"errors"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aykevl/go-xmlenc"
 	"github.com/beevik/etree"
@@ -18,13 +22,159 @@ const (
 	IDINServiceIDName        IDINAttribute = 1 << 12 // 4096
 	IDINServiceIDAddress     IDINAttribute = 1 << 10 // 1024
 	IDINServiceIDDateOfBirth IDINAttribute = 7 << 6  // 64 | 128 | 256 = 448
+	IDINServiceID18OrOlder   IDINAttribute = 1 << 6  // 64, part of IDINServiceIDDateOfBirth
 	IDINServiceIDGender      IDINAttribute = 1 << 4  // 16
 	IDINServiceIDTelephone   IDINAttribute = 1 << 2  // 4
 	IDINServiceIDEmail       IDINAttribute = 1 << 1  // 2
 )
 
+// Attribute names (as returned in IDINTransactionStatus.Attributes) holding
+// names and addresses, which are affected by CommonClient.NormalizeWhitespace.
+var idinNormalizedAttributes = map[string]bool{
+	"urn:nl:bvn:bankid:1.0:consumer.initials":                true,
+	"urn:nl:bvn:bankid:1.0:consumer.legallastname":           true,
+	"urn:nl:bvn:bankid:1.0:consumer.legallastnameprefix":     true,
+	"urn:nl:bvn:bankid:1.0:consumer.preferredlastname":       true,
+	"urn:nl:bvn:bankid:1.0:consumer.preferredlastnameprefix": true,
+	"urn:nl:bvn:bankid:1.0:consumer.partnerlastname":         true,
+	"urn:nl:bvn:bankid:1.0:consumer.partnerlastnameprefix":   true,
+	"urn:nl:bvn:bankid:1.0:consumer.street":                  true,
+	"urn:nl:bvn:bankid:1.0:consumer.houseno":                 true,
+	"urn:nl:bvn:bankid:1.0:consumer.housenosuf":              true,
+	"urn:nl:bvn:bankid:1.0:consumer.addressextra":            true,
+	"urn:nl:bvn:bankid:1.0:consumer.postalcode":              true,
+	"urn:nl:bvn:bankid:1.0:consumer.city":                    true,
+	"urn:nl:bvn:bankid:1.0:consumer.country":                 true,
+}
+
+// IDINSubStatus is a second-level SAML status code, which may be returned with
+// a non-successful iDIN transaction to explain the reason.
+type IDINSubStatus string
+
+// Known second-level status codes, as defined in the SAML 2.0 core
+// specification.
+const (
+	SubStatusAuthnFailed            IDINSubStatus = "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"            // The consumer could not be authenticated.
+	SubStatusRequestDenied          IDINSubStatus = "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"          // The issuer refused the request, e.g. the consumer declined.
+	SubStatusNoAuthnContext         IDINSubStatus = "urn:oasis:names:tc:SAML:2.0:status:NoAuthnContext"         // The requested level of assurance could not be met.
+	SubStatusRequestUnsupported     IDINSubStatus = "urn:oasis:names:tc:SAML:2.0:status:RequestUnsupported"     // The issuer doesn't support the request.
+	SubStatusUnknownPrincipal       IDINSubStatus = "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal"       // The consumer is not known at the issuer.
+	SubStatusInvalidAttrNameOrValue IDINSubStatus = "urn:oasis:names:tc:SAML:2.0:status:InvalidAttrNameOrValue" // An unexpected or invalid attribute was requested.
+)
+
+// ErrStatusAlreadyConsumed is matched (using errors.Is) by the error returned
+// from IDINClient.TransactionStatus when the acquirer indicates the final
+// status was already requested before. Use your stored result of the first
+// request in that case. See IDINClient.StatusConsumedCodes.
+var ErrStatusAlreadyConsumed = errors.New("idx: transaction status was already requested")
+
+// The service (bits in IDINAttribute) each known attribute belongs to. Metadata
+// attributes that are always returned have service 0.
+var idinAttributeServices = map[string]IDINAttribute{
+	"urn:nl:bvn:bankid:1.0:bankid.deliveredserviceid":        0,
+	"urn:nl:bvn:bankid:1.0:consumer.transientid":             0,
+	"urn:nl:bvn:bankid:1.0:consumer.bin":                     IDINServiceIDBIN,
+	"urn:nl:bvn:bankid:1.0:consumer.initials":                IDINServiceIDName,
+	"urn:nl:bvn:bankid:1.0:consumer.legallastname":           IDINServiceIDName,
+	"urn:nl:bvn:bankid:1.0:consumer.legallastnameprefix":     IDINServiceIDName,
+	"urn:nl:bvn:bankid:1.0:consumer.preferredlastname":       IDINServiceIDName,
+	"urn:nl:bvn:bankid:1.0:consumer.preferredlastnameprefix": IDINServiceIDName,
+	"urn:nl:bvn:bankid:1.0:consumer.partnerlastname":         IDINServiceIDName,
+	"urn:nl:bvn:bankid:1.0:consumer.partnerlastnameprefix":   IDINServiceIDName,
+	"urn:nl:bvn:bankid:1.0:consumer.street":                  IDINServiceIDAddress,
+	"urn:nl:bvn:bankid:1.0:consumer.houseno":                 IDINServiceIDAddress,
+	"urn:nl:bvn:bankid:1.0:consumer.housenosuf":              IDINServiceIDAddress,
+	"urn:nl:bvn:bankid:1.0:consumer.addressextra":            IDINServiceIDAddress,
+	"urn:nl:bvn:bankid:1.0:consumer.postalcode":              IDINServiceIDAddress,
+	"urn:nl:bvn:bankid:1.0:consumer.city":                    IDINServiceIDAddress,
+	"urn:nl:bvn:bankid:1.0:consumer.country":                 IDINServiceIDAddress,
+	"urn:nl:bvn:bankid:1.0:consumer.dateofbirth":             IDINServiceIDDateOfBirth &^ IDINServiceID18OrOlder,
+	"urn:nl:bvn:bankid:1.0:consumer.18orolder":               IDINServiceID18OrOlder,
+	"urn:nl:bvn:bankid:1.0:consumer.gender":                  IDINServiceIDGender,
+	"urn:nl:bvn:bankid:1.0:consumer.telephone":               IDINServiceIDTelephone,
+	"urn:nl:bvn:bankid:1.0:consumer.email":                   IDINServiceIDEmail,
+}
+
+// ErrSubIDMismatch is returned when the acquirer responds with a different sub
+// ID than the one in the request.
+var ErrSubIDMismatch = errors.New("idx: returned sub ID does not match")
+
 type IDINClient struct {
 	CommonClient
+
+	// StrictDecryption makes TransactionStatus fail entirely when one of the
+	// attributes cannot be decrypted, instead of returning the attributes that
+	// could be decrypted together with an *AttributeDecryptionError.
+	StrictDecryption bool
+
+	// KeepAssertion stores the SAML assertion as signed by the issuer in
+	// IDINTransactionStatus.SignedAssertion, for archiving it as proof of the
+	// identity verification, and a readable copy with the attributes
+	// decrypted in IDINTransactionStatus.Assertion.
+	KeepAssertion bool
+
+	// StatusConsumedCodes lists the acquirer error codes that indicate the
+	// final status of a transaction was already requested. The iDIN
+	// specification does not assign a dedicated code for this, so set it to
+	// the code(s) used by your acquirer. Errors with these codes match
+	// ErrStatusAlreadyConsumed.
+	StatusConsumedCodes []string
+
+	// ExpectedAttributes, when non-zero, makes TransactionStatus return an
+	// error when the bank returns attributes that are not part of these
+	// requested attributes, as the consumer did not consent to sharing them.
+	// Leave it zero if your bank legitimately returns extra attributes.
+	ExpectedAttributes IDINAttribute
+
+	// NameIDPolicyFormat, when set, adds a samlp:NameIDPolicy element with
+	// this Format to the AuthnRequest, to control the identifier returned for
+	// the consumer. SAML defines for example
+	// "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent" and
+	// "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"; which formats
+	// are accepted depends on your iDIN contract. NameIDPolicyAllowCreate sets
+	// its AllowCreate attribute.
+	NameIDPolicyFormat      string
+	NameIDPolicyAllowCreate bool
+
+	// DirectoryInterval is the minimum time between directory requests, used
+	// by CacheDirectory. Defaults to a week, the interval recommended by the
+	// iDIN specification.
+	DirectoryInterval time.Duration
+
+	// SAMLDestination, when set, is sent as the Destination attribute of the
+	// AuthnRequest: the endpoint of the issuer the request is meant for.
+	// When set, TransactionStatus also checks that the Destination of the SAML
+	// Response and the Recipient in its SubjectConfirmationData (if present)
+	// equal ReturnURL, to which the response was addressed.
+	SAMLDestination string
+
+	// SkipVersionCheck disables checking that the version and productID of
+	// responses are the same as those of the request. A mismatch usually
+	// means BaseURL points to a different product, like iDeal.
+	SkipVersionCheck bool
+}
+
+// AttributeDecryptionError is returned by IDINClient.TransactionStatus when
+// some of the encrypted attributes could not be decrypted.
+type AttributeDecryptionError struct {
+	Failures []AttributeDecryptionFailure
+}
+
+// AttributeDecryptionFailure describes a single attribute that could not be
+// decrypted. As the attribute name is part of the encrypted data, the attribute
+// is identified by the Id of the EncryptedData element or, when it has none, by
+// its position (starting at 0).
+type AttributeDecryptionFailure struct {
+	ID  string
+	Err error
+}
+
+func (e *AttributeDecryptionError) Error() string {
+	msg := "idx: could not decrypt " + strconv.Itoa(len(e.Failures)) + " attribute(s):"
+	for _, failure := range e.Failures {
+		msg += " " + failure.ID + ": " + failure.Err.Error() + ";"
+	}
+	return strings.TrimSuffix(msg, ";")
 }
 
 type IDINTransaction struct {
@@ -32,35 +182,116 @@ type IDINTransaction struct {
 	msg                     *etree.Element
 	issuerAuthenticationURL string
 	transactionID           string
+	signedRequest           []byte
 }
 
 // IDINTransactionStatus is the result of doing a status request of an iDIN
 // transaction. The returned attributes are only present after a successful
 // transaction.
 type IDINTransactionStatus struct {
-	Status     TransactionStatus
-	Attributes map[string]string
+	Status              TransactionStatus
+	SubStatus           IDINSubStatus // Second-level status code (see the SubStatus* constants), empty when absent.
+	StatusMessage       string        // Human-readable detail for the status, e.g. why it failed (optional). Not meant for consumers.
+	TransactionID       string
+	CreateDateTimestamp string // When the acquirer created the response.
+	StatusDateTimestamp string // When the status last changed (optional).
+	Attributes          map[string]string
+
+	// Only set for successful transactions.
+	AssertionID          string // ID of the SAML assertion.
+	AuthnContextClassRef string // Level of assurance that was delivered, e.g. "nl:bvn:bankid:1.0:loa3".
+
+	// Assertion is the SAML assertion with the attributes decrypted, only set
+	// when IDINClient.KeepAssertion is set. It contains personal data of the
+	// consumer, so store it as securely as the attributes themselves. As the
+	// attributes were replaced, the signature of the issuer in it is no
+	// longer valid: use SignedAssertion as evidence instead.
+	Assertion []byte
+
+	// SignedAssertion is the SAML assertion as signed by the issuer, with the
+	// attributes still encrypted, only set when IDINClient.KeepAssertion is
+	// set. Its signature can be verified later, and the attributes can be
+	// decrypted with the private key of the client certificate.
+	SignedAssertion []byte
+
+	// RawAttributes are the same attributes as in Attributes, in the order
+	// they were received and with their SAML metadata, for attributes that
+	// this package doesn't know about. Values are normalized the same way.
+	RawAttributes []IDINRawAttribute
+
+	// RawResponse is the AcquirerStatusRes as it was received, only set when
+	// KeepMessages is set on the client. The attributes in it are encrypted.
+	// It is also returned together with the error for an invalid status.
+	RawResponse []byte
+}
+
+// IDINRawAttribute is a decrypted SAML attribute, see
+// IDINTransactionStatus.RawAttributes.
+type IDINRawAttribute struct {
+	Name       string // Full URN, e.g. "urn:nl:bvn:bankid:1.0:consumer.city".
+	NameFormat string // The NameFormat of the attribute, empty when absent.
+	Value      string
+	Type       string // The xsi:type of the value, e.g. "xs:string", empty when absent.
+}
+
+// NewIDINClient creates a new iDIN client and checks the configuration using
+// Validate. Like NewIDealClient, it returns both the client and an
+// *IncompleteChainError when the certificate chain is incomplete.
+func NewIDINClient(opts ClientOptions) (*IDINClient, error) {
+	common, err := newCommonClient(opts)
+	if err != nil {
+		if _, ok := err.(*IncompleteChainError); !ok {
+			return nil, err
+		}
+	}
+	return &IDINClient{CommonClient: common}, err
 }
 
 func (c *IDINClient) createMessage(tag string) *etree.Element {
 	msg := c.CommonClient.createMessage(tag)
 	msg.CreateAttr("xmlns", "http://www.betaalvereniging.nl/iDx/messages/Merchant-Acquirer/1.0.0")
-	msg.CreateAttr("version", "1.0.0")
-	msg.CreateAttr("productID", "NL:BVN:BankID:1.0")
+	msg.CreateAttr("version", idinVersion)
+	msg.CreateAttr("productID", idinProductID)
 	return msg
 }
 
-func (c *IDINClient) request(msg string) (*etree.Document, error) {
-	doc, err := c.CommonClient.request(msg)
-	if doc != nil && doc.ChildElements()[0].Tag == "AcquirerErrorRes" {
-		return nil, &AcquirerError{
-			ErrorCode:       doc.FindElement("/AcquirerErrorRes/Error/errorCode").Text(),
-			ErrorMessage:    doc.FindElement("/AcquirerErrorRes/Error/errorMessage").Text(),
-			ErrorDetail:     doc.FindElement("/AcquirerErrorRes/Error/errorDetail").Text(),
-			ConsumerMessage: doc.FindElement("/AcquirerErrorRes/Error/consumerMessage").Text(),
-		}
+// Version and product ID of the iDIN messages sent by this package.
+const (
+	idinVersion   = "1.0.0"
+	idinProductID = "NL:BVN:BankID:1.0"
+)
+
+// validateMessage validates the response like CommonClient.validateMessage, and
+// additionally checks that the version and productID of the response match
+// those of the request, unless SkipVersionCheck is set.
+func (c *IDINClient) validateMessage(msg *etree.Document, expected string) (*etree.Element, error) {
+	root, err := c.CommonClient.validateMessage(msg, expected)
+	if err != nil || c.SkipVersionCheck {
+		return root, err
+	}
+	if version := root.SelectAttrValue("version", ""); version != idinVersion {
+		return nil, errors.New("idx: response has version " + version + ", expected " + idinVersion)
+	}
+	if productID := root.SelectAttrValue("productID", ""); productID != idinProductID {
+		return nil, errors.New("idx: response has productID " + productID + ", expected " + idinProductID)
 	}
-	return doc, err
+	return root, nil
+}
+
+func (c *IDINClient) request(ctx context.Context, msg []byte) (*etree.Document, []byte, error) {
+	doc, raw, err := c.CommonClient.request(ctx, msg)
+	if doc != nil && doc.Root().Tag == "AcquirerErrorRes" {
+		return nil, nil, c.acquirerError(doc)
+	}
+	return doc, raw, err
+}
+
+// directoryInterval returns DirectoryInterval or its default.
+func (c *IDINClient) directoryInterval() time.Duration {
+	if c.DirectoryInterval == 0 {
+		return 7 * 24 * time.Hour
+	}
+	return c.DirectoryInterval
 }
 
 // Do a directory request, to get a list of banks.
@@ -68,17 +299,38 @@ func (c *IDINClient) request(msg string) (*etree.Document, error) {
 // It should be issued at least once a week, but may not be issued very often
 // (e.g. not every request). The recommended interval is once a week, see the
 // iDIN specification for details ("iDIN Directory Protocol").
+//
+// Malformed issuers are left out of the directory, in which case both the
+// directory and a *DirectoryParseError are returned.
+//
+// The iDIN directory only lists the issuer ID and name of each bank: it does
+// not say which services or attributes a bank supports. All banks in the
+// directory are expected to provide all services.
 func (c *IDINClient) DirectoryRequest() (*Directory, error) {
+	return c.DirectoryRequestContext(context.Background())
+}
+
+// DirectoryRequestContext is like DirectoryRequest, but the request is aborted
+// when ctx is cancelled.
+func (c *IDINClient) DirectoryRequestContext(ctx context.Context) (*Directory, error) {
+	return c.cachedDirectory(ctx, c.directoryInterval(), c.directoryRequest)
+}
+
+func (c *IDINClient) directoryRequest(ctx context.Context) (*Directory, error) {
 	msg := c.createMessage("DirectoryReq")
-	doc, err := c.request(c.signMessage(msg))
+	signed, err := c.signMessage(msg)
 	if err != nil {
 		return nil, err
 	}
-	response, err := c.validateMessage(doc)
+	doc, _, err := c.request(ctx, signed)
 	if err != nil {
 		return nil, err
 	}
-	return c.parseDirectoryRequest(response), nil
+	response, err := c.validateMessage(doc, "DirectoryRes")
+	if err != nil {
+		return nil, err
+	}
+	return c.parseDirectoryRequest(response)
 }
 
 // Request the status of a transaction. Returns an error on
@@ -86,14 +338,36 @@ func (c *IDINClient) DirectoryRequest() (*Directory, error) {
 // error, the status may still be something other than "Success", you will have
 // to handle each possible status.
 //
+// When some attributes could not be decrypted, both the status (with the
+// attributes that could be decrypted) and an *AttributeDecryptionError are
+// returned, unless StrictDecryption is set.
+//
 // This call may only be done once upon redirection from the consumer bank. See
 // 11.5 "Restrictions on AcquirerStatusReq" in the iDIN specification for
 // details.
 func (c *IDINClient) TransactionStatus(trxid string) (*IDINTransactionStatus, error) {
+	return c.TransactionStatusContext(context.Background(), trxid)
+}
+
+// TransactionStatusContext is like TransactionStatus, but the request is
+// aborted when ctx is cancelled.
+func (c *IDINClient) TransactionStatusContext(ctx context.Context, trxid string) (*IDINTransactionStatus, error) {
 	msg := c.createMessage("AcquirerStatusReq")
 	msg.CreateElement("Transaction").CreateElement("transactionID").SetText(trxid)
-	doc, err := c.request(c.signMessage(msg))
+	signed, err := c.signMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	doc, raw, err := c.request(ctx, signed)
 	if err != nil {
+		if acquirerErr, ok := err.(*AcquirerError); ok {
+			for _, code := range c.StatusConsumedCodes {
+				if acquirerErr.ErrorCode == code {
+					acquirerErr.statusConsumed = true
+					break
+				}
+			}
+		}
 		return nil, err
 	}
 
@@ -102,17 +376,46 @@ func (c *IDINClient) TransactionStatus(trxid string) (*IDINTransactionStatus, er
 	// to work around the issue:
 	// WARNING: DO NOT DO THIS IN PRODUCTION! Fix the bug first!
 	//root := doc.Element
-	root, err := c.validateMessage(doc)
+	root, err := c.validateMessage(doc, "AcquirerStatusRes")
 	if err != nil {
 		return nil, err
 	}
+	return c.parseTransactionStatus(root, trxid, raw)
+}
 
-	transactionID := root.FindElement("/AcquirerStatusRes/Transaction/transactionID").Text()
+// parseTransactionStatus parses the validated AcquirerStatusRes of the given
+// transaction and decrypts its attributes. The raw response is only used for
+// RawResponse.
+//
+// Paths are relative to the root, as the Verifier may return a copy of the
+// signed element that is not part of the document.
+func (c *IDINClient) parseTransactionStatus(root *etree.Element, trxid string, raw []byte) (*IDINTransactionStatus, error) {
+	transactionID, err := findText(root, "Transaction/transactionID")
+	if err != nil {
+		return nil, err
+	}
 	if transactionID != trxid {
 		return nil, errors.New("idx: returned transaction ID does not match")
 	}
 
-	statusCodeEl := root.FindElement("/AcquirerStatusRes/Transaction/container/Response/Status/StatusCode")
+	if c.SAMLDestination != "" {
+		for _, path := range []string{
+			"Transaction/container/Response[@Destination]",
+			"Transaction/container/Response/Assertion/Subject/SubjectConfirmation/SubjectConfirmationData[@Recipient]",
+		} {
+			if el := root.FindElement(path); el != nil {
+				attr := el.SelectAttrValue("Destination", el.SelectAttrValue("Recipient", ""))
+				if attr != c.ReturnURL {
+					return nil, errors.New("idx: SAML response addressed to " + attr + " instead of ReturnURL")
+				}
+			}
+		}
+	}
+
+	statusCodeEl := root.FindElement("Transaction/container/Response/Status/StatusCode")
+	if statusCodeEl == nil {
+		return nil, errors.New("idx: missing element in response: StatusCode")
+	}
 	var status TransactionStatus
 	statusString := statusCodeEl.SelectAttrValue("Value", "")
 	// WARNING: untested status strings.
@@ -128,81 +431,310 @@ func (c *IDINClient) TransactionStatus(trxid string) (*IDINTransactionStatus, er
 	case "urn:oasis:names:tc:SAML:2.0:status:Open":
 		status = Open
 	default:
-		return nil, errors.New("idin: invalid status: " + statusString)
+		// Return the status too, so the RawResponse can be inspected.
+		result := &IDINTransactionStatus{Status: InvalidStatus, TransactionID: transactionID}
+		if c.KeepMessages {
+			result.RawResponse = raw
+		}
+		return result, errors.New("idin: invalid status: " + statusString)
 	}
 
 	result := &IDINTransactionStatus{
-		Status: status,
+		Status:              status,
+		TransactionID:       transactionID,
+		CreateDateTimestamp: optionalText(root, "createDateTimestamp"),
+		StatusDateTimestamp: optionalText(root, "Transaction/statusDateTimestamp"),
+		StatusMessage:       optionalText(root, "Transaction/container/Response/Status/StatusMessage"),
+	}
+	if c.KeepMessages {
+		result.RawResponse = raw
+	}
+	if subStatusEl := statusCodeEl.SelectElement("StatusCode"); subStatusEl != nil {
+		result.SubStatus = IDINSubStatus(subStatusEl.SelectAttrValue("Value", ""))
 	}
 	if status == Success {
+		// The private key may be held elsewhere when a custom Signer is used,
+		// but it is still needed to decrypt the attributes.
+		privateKey, ok := c.Certificate.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("idx: cannot decrypt attributes: private key is not an RSA key")
+		}
 		result.Attributes = make(map[string]string)
-		for _, el := range root.FindElements("/AcquirerStatusRes/Transaction/container/Response/Assertion/AttributeStatement/EncryptedAttribute/EncryptedData") {
-			el, err := xmlenc.DecryptElement(el, c.Certificate.PrivateKey.(*rsa.PrivateKey))
+		decryptErr := &AttributeDecryptionError{}
+		assertion := root.FindElement("Transaction/container/Response/Assertion")
+		if assertion != nil {
+			result.AssertionID = assertion.SelectAttrValue("ID", "")
+			result.AuthnContextClassRef = optionalText(assertion, "AuthnStatement/AuthnContext/AuthnContextClassRef")
+			if c.KeepAssertion {
+				// Copy it before the attributes are replaced below.
+				result.SignedAssertion, err = detachedCopy(assertion)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		for i, encryptedAttr := range root.FindElements("Transaction/container/Response/Assertion/AttributeStatement/EncryptedAttribute") {
+			el := encryptedAttr.SelectElement("EncryptedData")
+			if el == nil {
+				continue
+			}
+			id := el.SelectAttrValue("Id", strconv.Itoa(i))
+			el, err := xmlenc.DecryptElement(inlineEncryptedKey(el, assertion), privateKey)
 			if err != nil {
-				return nil, err
+				if c.StrictDecryption {
+					return nil, err
+				}
+				decryptErr.Failures = append(decryptErr.Failures, AttributeDecryptionFailure{id, err})
+				continue
+			}
+			attr := el.FindElement("Attribute")
+			if attr == nil {
+				err := errors.New("idx: decrypted attribute has no Attribute element")
+				if c.StrictDecryption {
+					return nil, err
+				}
+				decryptErr.Failures = append(decryptErr.Failures, AttributeDecryptionFailure{id, err})
+				continue
+			}
+			key := attr.SelectAttrValue("Name", "")
+			value := optionalText(attr, "AttributeValue")
+			if idinNormalizedAttributes[key] {
+				value = c.normalize(value)
 			}
-			key := el.FindElement("Attribute").SelectAttrValue("Name", "")
-			value := el.FindElement("Attribute/AttributeValue").Text()
 			result.Attributes[key] = value
+			var valueType string
+			if valueEl := attr.SelectElement("AttributeValue"); valueEl != nil {
+				valueType = valueEl.SelectAttrValue("xsi:type", "")
+			}
+			result.RawAttributes = append(result.RawAttributes, IDINRawAttribute{
+				Name:       key,
+				NameFormat: attr.SelectAttrValue("NameFormat", ""),
+				Value:      value,
+				Type:       valueType,
+			})
+			if c.KeepAssertion {
+				// Replace the encrypted attribute with the decrypted one.
+				statement := encryptedAttr.Parent()
+				statement.InsertChild(encryptedAttr, attr.Copy())
+				statement.RemoveChild(encryptedAttr)
+			}
+		}
+		if c.KeepAssertion && assertion != nil {
+			result.Assertion, err = detachedCopy(assertion)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if c.ExpectedAttributes != 0 {
+			if unexpected := unexpectedAttributes(result.Attributes, c.ExpectedAttributes); len(unexpected) != 0 {
+				return nil, errors.New("idx: received attributes that were not requested: " + strings.Join(unexpected, ", "))
+			}
+		}
+		if len(decryptErr.Failures) != 0 {
+			return result, decryptErr
 		}
 	}
 	return result, nil
 }
 
+// detachedCopy serializes el as a document of its own. The namespace
+// declarations of its ancestors are copied to it, so that the namespace
+// prefixes in it (and its signature) can still be resolved.
+func detachedCopy(el *etree.Element) ([]byte, error) {
+	root := el.Copy()
+	for parent := el.Parent(); parent != nil; parent = parent.Parent() {
+		for _, attr := range parent.Attr {
+			if attr.Space == "xmlns" || attr.Space == "" && attr.Key == "xmlns" {
+				if root.SelectAttr(attr.FullKey()) == nil {
+					root.CreateAttr(attr.FullKey(), attr.Value)
+				}
+			}
+		}
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(root)
+	return doc.WriteToBytes()
+}
+
+// unexpectedAttributes returns the sorted names of the attributes that are not
+// part of the expected services.
+func unexpectedAttributes(attributes map[string]string, expected IDINAttribute) []string {
+	var unexpected []string
+	for key := range attributes {
+		service, ok := idinAttributeServices[key]
+		if !ok || (service != 0 && service&expected == 0) {
+			unexpected = append(unexpected, key)
+		}
+	}
+	sort.Strings(unexpected)
+	return unexpected
+}
+
+// inlineEncryptedKey returns the EncryptedData element with the EncryptedKey
+// in its KeyInfo, as that is where xmlenc.DecryptElement looks for it. Banks
+// may instead put the EncryptedKey next to the EncryptedData, or share a single
+// EncryptedKey between all attributes and refer to it using a RetrievalMethod
+// or a DataReference. In that case a copy of the EncryptedData is returned with
+// the referenced EncryptedKey added.
+func inlineEncryptedKey(data, assertion *etree.Element) *etree.Element {
+	if data.FindElement("KeyInfo/EncryptedKey") != nil || assertion == nil {
+		return data
+	}
+	keys := assertion.FindElements(".//EncryptedKey")
+	var key *etree.Element
+	if method := data.FindElement("KeyInfo/RetrievalMethod"); method != nil {
+		keyID := strings.TrimPrefix(method.SelectAttrValue("URI", ""), "#")
+		for _, k := range keys {
+			if k.SelectAttrValue("Id", "") == keyID {
+				key = k
+				break
+			}
+		}
+	}
+	if dataID := data.SelectAttrValue("Id", ""); key == nil && dataID != "" {
+	search:
+		for _, k := range keys {
+			for _, ref := range k.FindElements("ReferenceList/DataReference") {
+				if ref.SelectAttrValue("URI", "") == "#"+dataID {
+					key = k
+					break search
+				}
+			}
+		}
+	}
+	if key == nil && data.Parent() != nil {
+		key = data.Parent().SelectElement("EncryptedKey")
+	}
+	if key == nil {
+		return data
+	}
+
+	data = data.Copy()
+	keyInfo := data.SelectElement("KeyInfo")
+	if keyInfo == nil {
+		keyInfo = etree.NewElement("ds:KeyInfo")
+		keyInfo.CreateAttr("xmlns:ds", "http://www.w3.org/2000/09/xmldsig#")
+		data.InsertChild(data.SelectElement("CipherData"), keyInfo)
+	}
+	keyInfo.AddChild(key.Copy())
+	return data
+}
+
 // Create a transaction object but do not start it.
 //
 // The issuer is the consumer-selected bank, the entranceCode is a session token
 // to resume an existing session so the user doesn't get logged out during the
-// iDIN transaction, and attributes is a set of flags indicating the requested
-// attributes (request multiple attributes by ORing them together).
+// iDIN transaction, id is a unique ID for the SAML request (see NewSAMLID), and
+// attributes is a set of flags indicating the requested attributes (request
+// multiple attributes by ORing them together).
 func (c *IDINClient) NewTransaction(issuer, entranceCode, id string, attributes IDINAttribute) *IDINTransaction {
 	msg := c.createMessage("AcquirerTrxReq")
-	merchantEl := msg.FindElement("/Merchant")
-	merchantEl.CreateElement("merchantReturnURL").SetText(c.ReturnURL)
-	issuerEl := msg.CreateElement("Issuer")
-	issuerEl.CreateElement("issuerID").SetText(issuer)
-	msg.InsertChild(merchantEl, issuerEl) // order matters: Issuer must occur before Merchant
-	transaction := msg.CreateElement("Transaction")
-	transaction.CreateElement("language").SetText("nl")
-	transaction.CreateElement("entranceCode").SetText(entranceCode)
+	transaction := c.createTransaction(msg, issuer, entranceCode)
 	container := transaction.CreateElement("container")
 	samlAuthRequest := container.CreateElement("samlp:AuthnRequest")
 	samlAuthRequest.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
 	samlAuthRequest.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
 	samlAuthRequest.CreateAttr("ID", id)
 	samlAuthRequest.CreateAttr("Version", "2.0")
-	samlAuthRequest.CreateAttr("IssueInstant", msg.FindElement("/createDateTimestamp").Text())
+	// Use the same instant as the createDateTimestamp, but in the format SAML
+	// requires. Parsing can't fail, as the timestamp was just created.
+	issueInstant, _ := time.Parse(time.RFC3339, msg.FindElement("/createDateTimestamp").Text())
+	samlAuthRequest.CreateAttr("IssueInstant", samlTimestamp(issueInstant))
 	samlAuthRequest.CreateAttr("ProtocolBinding", "nl:bvn:bankid:1.0:protocol:iDx")
 	samlAuthRequest.CreateAttr("AssertionConsumerServiceURL", c.ReturnURL)
+	if c.SAMLDestination != "" {
+		samlAuthRequest.CreateAttr("Destination", c.SAMLDestination)
+	}
 	samlAuthRequest.CreateAttr("AttributeConsumingServiceIndex", strconv.Itoa(int(attributes)))
 	samlAuthRequest.CreateElement("saml:Issuer").SetText(c.MerchantID)
+	if c.NameIDPolicyFormat != "" {
+		policy := samlAuthRequest.CreateElement("samlp:NameIDPolicy")
+		policy.CreateAttr("Format", c.NameIDPolicyFormat)
+		policy.CreateAttr("AllowCreate", strconv.FormatBool(c.NameIDPolicyAllowCreate))
+	}
 	context := samlAuthRequest.CreateElement("samlp:RequestedAuthnContext")
 	context.CreateAttr("Comparison", "minimum")
 	context.CreateElement("saml:AuthnContextClassRef").SetText("nl:bvn:bankid:1.0:loa3")
 	return &IDINTransaction{client: c, msg: msg}
 }
 
+// samlTimestamp formats t as a SAML xsd:dateTime, which must be in UTC with a
+// "Z" suffix regardless of CommonClient.NumericUTCOffset. It has millisecond
+// precision, like the timestamps in iDIN messages.
+func samlTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// Validate checks the transaction before it is sent to the acquirer. It is
+// called by Start, but can also be called right after NewTransaction.
+func (t *IDINTransaction) Validate() error {
+	return ValidateEntranceCode(optionalText(t.msg, "Transaction/entranceCode"))
+}
+
 // Start a transaction.
 //
 // Note that you must save the transaction ID upon creation, so that it can be
 // closed after a day or so when the client closes the browser window/tab before
 // completion.
 func (t *IDINTransaction) Start() error {
-	doc, err := t.client.request(t.client.signMessage(t.msg))
+	return t.StartContext(context.Background())
+}
+
+// StartContext is like Start, but the request is aborted when ctx is
+// cancelled.
+func (t *IDINTransaction) StartContext(ctx context.Context) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	signed, err := t.client.signMessage(t.msg)
+	if err != nil {
+		return err
+	}
+	if t.client.KeepMessages {
+		t.signedRequest = signed
+	}
+	doc, _, err := t.client.request(ctx, signed)
 	if err != nil {
 		return err
 	}
-	response, err := t.client.validateMessage(doc)
+	response, err := t.client.validateMessage(doc, "AcquirerTrxRes")
 	if err != nil {
 		return err
 	}
 
-	t.issuerAuthenticationURL = response.FindElement("/Issuer/issuerAuthenticationURL").Text()
-	t.transactionID = response.FindElement("/Transaction/transactionID").Text()
+	issuerAuthenticationURL, err := findText(response, "/Issuer/issuerAuthenticationURL")
+	if err != nil {
+		return err
+	}
+	transactionID, err := findText(response, "/Transaction/transactionID")
+	if err != nil {
+		return err
+	}
+	if subID := response.FindElement("Merchant/subID"); subID != nil && subID.Text() != optionalText(t.msg, "Merchant/subID") {
+		return ErrSubIDMismatch
+	}
+	t.issuerAuthenticationURL = issuerAuthenticationURL
+	t.transactionID = transactionID
 
 	return nil
 }
 
+// SetLanguage overrides the language of the bank pages for this transaction,
+// instead of using CommonClient.Languages. Like for iDeal, it is set in the
+// Transaction element: the SAML request has no language. It returns an error
+// when the language is not in SupportedLanguages. It must be called before
+// Start.
+func (t *IDINTransaction) SetLanguage(language string) error {
+	return setLanguage(t.msg, language)
+}
+
+// SetSubID overrides the sub ID of the client for this transaction, for
+// merchants with multiple shops. It must be called before Start.
+func (t *IDINTransaction) SetSubID(subID string) {
+	t.msg.FindElement("Merchant/subID").SetText(subIDOrDefault(subID))
+}
+
 // Return the URL to which to redirect the consumer to start the iDIN process
 // for the consumer.
 func (t *IDINTransaction) IssuerAuthenticationURL() string {
@@ -213,3 +745,123 @@ func (t *IDINTransaction) IssuerAuthenticationURL() string {
 func (t *IDINTransaction) TransactionID() string {
 	return t.transactionID
 }
+
+// Return the signed request as it was sent by Start, or nil if KeepMessages
+// is not set on the client.
+func (t *IDINTransaction) SignedRequest() []byte {
+	return t.signedRequest
+}
+
+// IsOver returns whether the consumer is at least the given age, and whether
+// that could be determined at all. It uses the date of birth when available,
+// and otherwise the 18-or-older attribute (which only answers IsOver(18)).
+//
+// Banks may return a partial date of birth, with the month and/or day set to
+// "00". The answer is then only determined when it is the same for every
+// possible date: for example, when only the birth year is known, a consumer
+// born in 2000 is over 18 in 2019 but undetermined during 2018.
+func (s *IDINTransactionStatus) IsOver(age int) (over, ok bool) {
+	if dob := s.Attributes["urn:nl:bvn:bankid:1.0:consumer.dateofbirth"]; len(dob) == 8 {
+		year, errYear := strconv.Atoi(dob[:4])
+		month, errMonth := strconv.Atoi(dob[4:6])
+		day, errDay := strconv.Atoi(dob[6:])
+		if errYear == nil && errMonth == nil && errDay == nil && month <= 12 {
+			// Determine the earliest and latest possible date of birth.
+			firstMonth, lastMonth := time.Month(month), time.Month(month)
+			if month == 0 {
+				firstMonth, lastMonth = time.January, time.December
+			}
+			firstDay, lastDay := day, day
+			if day == 0 {
+				firstDay = 1
+				lastDay = time.Date(year, lastMonth+1, 0, 0, 0, 0, 0, time.UTC).Day()
+			}
+			now := time.Now()
+			today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+			if !time.Date(year+age, lastMonth, lastDay, 0, 0, 0, 0, time.UTC).After(today) {
+				return true, true
+			}
+			if time.Date(year+age, firstMonth, firstDay, 0, 0, 0, 0, time.UTC).After(today) {
+				return false, true
+			}
+			return false, false
+		}
+	}
+	if value, present := s.Attributes["urn:nl:bvn:bankid:1.0:consumer.18orolder"]; present && age == 18 {
+		return value == "true", true
+	}
+	return false, false
+}
+
+// Telephone returns the telephone number of the consumer in E.164 format (e.g.
+// "+31612345678"), and whether it could be normalized. The raw value as sent by
+// the bank stays available in Attributes. When the number can't be
+// normalized, the raw value is returned with ok set to false.
+//
+// Spaces, dashes, dots and parentheses are removed, as is a "(0)" after the
+// country code. A "00" prefix is replaced by "+", and a number starting with a
+// single 0 is assumed to be a Dutch number of 10 digits. Other numbers without
+// a country code can't be normalized. The length of the number is checked,
+// but not whether it actually exists.
+func (s *IDINTransactionStatus) Telephone() (number string, ok bool) {
+	raw := s.Attributes["urn:nl:bvn:bankid:1.0:consumer.telephone"]
+	number = strings.Replace(raw, "(0)", "", 1)
+	number = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, number)
+	switch {
+	case strings.HasPrefix(number, "+"):
+	case strings.HasPrefix(number, "00"):
+		number = "+" + number[2:]
+	case strings.HasPrefix(number, "0") && len(number) == 10:
+		number = "+31" + number[1:]
+	default:
+		return raw, false
+	}
+	// E.164 numbers have at most 15 digits, and start with a nonzero country
+	// code.
+	digits := number[1:]
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return raw, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return raw, false
+		}
+	}
+	return number, true
+}
+
+// IDINAddress is the address of the consumer, see
+// IDINTransactionStatus.Address. Fields are empty when the bank didn't return
+// them.
+type IDINAddress struct {
+	Street              string
+	HouseNumber         string // e.g. "12"
+	HouseNumberAddition string // e.g. "A" or "bis", empty when there is none
+	AddressExtra        string // other address information, e.g. "t/o" or a floor
+	PostalCode          string
+	City                string
+	Country             string // ISO 3166-1 alpha-2 code, e.g. "NL"
+}
+
+// Address returns the address attributes of the consumer, and whether any were
+// returned at all. The house number and its addition are separate attributes
+// in iDIN and are kept separate, as postal databases expect them that way.
+func (s *IDINTransactionStatus) Address() (address IDINAddress, ok bool) {
+	const prefix = "urn:nl:bvn:bankid:1.0:consumer."
+	address = IDINAddress{
+		Street:              s.Attributes[prefix+"street"],
+		HouseNumber:         s.Attributes[prefix+"houseno"],
+		HouseNumberAddition: s.Attributes[prefix+"housenosuf"],
+		AddressExtra:        s.Attributes[prefix+"addressextra"],
+		PostalCode:          s.Attributes[prefix+"postalcode"],
+		City:                s.Attributes[prefix+"city"],
+		Country:             s.Attributes[prefix+"country"],
+	}
+	return address, address != IDINAddress{}
+}
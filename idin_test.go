@@ -0,0 +1,482 @@
+package idx
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+const testIDINStatusRes = `<?xml version="1.0" encoding="UTF-8"?>
+<AcquirerStatusRes xmlns="http://www.betaalvereniging.nl/iDx/messages/Merchant-Acquirer/1.0.0" version="1.0.0" productID="NL:BVN:BankID:1.0">
+  <createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>
+  <Acquirer>
+    <acquirerID>0030</acquirerID>
+  </Acquirer>
+  <Transaction>
+    <transactionID>0030000123456789</transactionID>
+    <statusDateTimestamp>2017-01-02T15:04:00.000Z</statusDateTimestamp>
+    <container>
+      <samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="RES-1" Version="2.0" IssueInstant="2017-01-02T15:04:00Z" Destination="https://example.com/return">
+        <samlp:Status>
+          <samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/>
+        </samlp:Status>
+        <saml:Assertion ID="ASS-1" Version="2.0" IssueInstant="2017-01-02T15:04:00Z">
+          <saml:AuthnStatement AuthnInstant="2017-01-02T15:04:00Z">
+            <saml:AuthnContext>
+              <saml:AuthnContextClassRef>nl:bvn:bankid:1.0:loa3</saml:AuthnContextClassRef>
+            </saml:AuthnContext>
+          </saml:AuthnStatement>
+          <saml:AttributeStatement>
+            <saml:EncryptedAttribute>
+              <xenc:EncryptedData xmlns:xenc="http://www.w3.org/2001/04/xmlenc#" Id="attr-1" Type="http://www.w3.org/2001/04/xmlenc#Element">
+                <xenc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes256-cbc"/>
+                <xenc:CipherData>
+                  <xenc:CipherValue>AAAAAAAAAAAAAAAAAAAAAA==</xenc:CipherValue>
+                </xenc:CipherData>
+              </xenc:EncryptedData>
+            </saml:EncryptedAttribute>
+          </saml:AttributeStatement>
+        </saml:Assertion>
+      </samlp:Response>
+    </container>
+  </Transaction>
+</AcquirerStatusRes>`
+
+const testIDINFailureStatusRes = `<?xml version="1.0" encoding="UTF-8"?>
+<AcquirerStatusRes xmlns="http://www.betaalvereniging.nl/iDx/messages/Merchant-Acquirer/1.0.0" version="1.0.0" productID="NL:BVN:BankID:1.0">
+  <createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>
+  <Acquirer>
+    <acquirerID>0030</acquirerID>
+  </Acquirer>
+  <Transaction>
+    <transactionID>0030000123456789</transactionID>
+    <statusDateTimestamp>2017-01-02T15:04:00.000Z</statusDateTimestamp>
+    <container>
+      <samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="RES-1" Version="2.0" IssueInstant="2017-01-02T15:04:00Z">
+        <samlp:Status>
+          <samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Failure">
+            <samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"/>
+          </samlp:StatusCode>
+          <samlp:StatusMessage>Consumer could not be authenticated</samlp:StatusMessage>
+        </samlp:Status>
+      </samlp:Response>
+    </container>
+  </Transaction>
+</AcquirerStatusRes>`
+
+// parseTestIDINStatus parses an AcquirerStatusRes message of transaction
+// 0030000123456789 with parseTransactionStatus.
+func parseTestIDINStatus(t testing.TB, c *IDINClient, msg string) (*IDINTransactionStatus, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(msg); err != nil {
+		t.Fatal(err)
+	}
+	return c.parseTransactionStatus(doc.Root(), "0030000123456789", []byte(msg))
+}
+
+func TestIDINStatusMessage(t *testing.T) {
+	status, err := parseTestIDINStatus(t, &IDINClient{}, testIDINFailureStatusRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != Failure || status.SubStatus != SubStatusAuthnFailed {
+		t.Errorf("expected Failure with AuthnFailed, got %v with %s", status.Status, status.SubStatus)
+	}
+	if status.StatusMessage != "Consumer could not be authenticated" {
+		t.Errorf("unexpected StatusMessage: %q", status.StatusMessage)
+	}
+	if status.TransactionID != "0030000123456789" || status.StatusDateTimestamp != "2017-01-02T15:04:00.000Z" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func FuzzIDINStatus(f *testing.F) {
+	f.Add([]byte(testIDINStatusRes))
+	f.Add([]byte(testIDINFailureStatusRes))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromBytes(msg); err != nil || doc.Root() == nil {
+			return
+		}
+		c := &IDINClient{
+			CommonClient:       CommonClient{Certificate: testMerchantCert, ReturnURL: "https://example.com/return"},
+			KeepAssertion:      true,
+			ExpectedAttributes: IDINServiceIDName,
+			SAMLDestination:    "https://example.com/idin",
+		}
+		status, err := c.parseTransactionStatus(doc.Root(), "0030000123456789", msg)
+		if err == nil && status == nil {
+			t.Error("no status and no error")
+		}
+	})
+}
+
+// testIDINTrxRes returns an iDIN AcquirerTrxRes that echoes the given sub ID.
+func testIDINTrxRes(subID string) string {
+	return signResponse(testAcquirerCert, `<AcquirerTrxRes xmlns="http://www.betaalvereniging.nl/iDx/messages/Merchant-Acquirer/1.0.0" version="1.0.0" productID="NL:BVN:BankID:1.0">
+  <createDateTimestamp>2017-01-02T15:04:05.000Z</createDateTimestamp>
+  <Acquirer>
+    <acquirerID>0030</acquirerID>
+  </Acquirer>
+  <Merchant>
+    <merchantID>002054205</merchantID>
+    <subID>`+subID+`</subID>
+  </Merchant>
+  <Issuer>
+    <issuerAuthenticationURL>https://bank.example.com/idin</issuerAuthenticationURL>
+  </Issuer>
+  <Transaction>
+    <transactionID>0030000123456789</transactionID>
+    <transactionCreateDateTimestamp>2017-01-02T15:04:05.000Z</transactionCreateDateTimestamp>
+  </Transaction>
+</AcquirerTrxRes>`)
+}
+
+func TestIDINSubID(t *testing.T) {
+	var echo string
+	sent := ""
+	server := newTestServer(t, func(req *etree.Element) string {
+		sent = optionalText(req, "Merchant/subID")
+		if echo == "" {
+			return testIDINTrxRes(sent)
+		}
+		return testIDINTrxRes(echo)
+	})
+	c := &IDINClient{CommonClient: newTestClient(server.URL)}
+	c.SubID = "1"
+
+	// The sub ID as sent in the request, for the sub ID passed to SetSubID
+	// (if any).
+	for _, tc := range []struct {
+		setSubID bool
+		subID    string
+		sent     string
+	}{
+		{false, "", "1"},
+		{true, "2", "2"},
+		{true, "", "0"},
+	} {
+		transaction := c.NewTransaction("RABONL2U", "entranceCode", "_1", IDINServiceIDName)
+		if tc.setSubID {
+			transaction.SetSubID(tc.subID)
+		}
+		if err := transaction.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if sent != tc.sent {
+			t.Errorf("expected subID %s in request, got %s", tc.sent, sent)
+		}
+		if transaction.TransactionID() != "0030000123456789" {
+			t.Errorf("unexpected transaction ID: %s", transaction.TransactionID())
+		}
+	}
+
+	// A response for another sub ID is rejected.
+	echo = "1"
+	transaction := c.NewTransaction("RABONL2U", "entranceCode", "_2", IDINServiceIDName)
+	transaction.SetSubID("2")
+	if err := transaction.Start(); !errors.Is(err, ErrSubIDMismatch) {
+		t.Errorf("expected ErrSubIDMismatch, got %v", err)
+	}
+	if transaction.TransactionID() != "" {
+		t.Errorf("transaction was started with mismatched sub ID: %s", transaction.TransactionID())
+	}
+}
+
+func TestUnexpectedAttributes(t *testing.T) {
+	attributes := map[string]string{
+		"urn:nl:bvn:bankid:1.0:bankid.deliveredserviceid": "64",
+		"urn:nl:bvn:bankid:1.0:consumer.18orolder":        "true",
+	}
+	if unexpected := unexpectedAttributes(attributes, IDINServiceID18OrOlder); len(unexpected) != 0 {
+		t.Errorf("unexpected attributes: %v", unexpected)
+	}
+
+	// The date of birth is not part of the 18 or older check.
+	attributes["urn:nl:bvn:bankid:1.0:consumer.dateofbirth"] = "19700101"
+	attributes["urn:nl:bvn:bankid:1.0:consumer.unknown"] = "?"
+	unexpected := unexpectedAttributes(attributes, IDINServiceID18OrOlder)
+	expected := []string{"urn:nl:bvn:bankid:1.0:consumer.dateofbirth", "urn:nl:bvn:bankid:1.0:consumer.unknown"}
+	if !reflect.DeepEqual(unexpected, expected) {
+		t.Errorf("expected %v, got %v", expected, unexpected)
+	}
+	if unexpected := unexpectedAttributes(attributes, IDINServiceIDDateOfBirth); len(unexpected) != 1 {
+		t.Errorf("expected only the unknown attribute, got %v", unexpected)
+	}
+}
+
+func TestKeepAssertion(t *testing.T) {
+	c := &IDINClient{CommonClient: CommonClient{Certificate: testMerchantCert}, KeepAssertion: true}
+	status, _ := parseTestIDINStatus(t, c, testIDINStatusRes)
+	if status == nil {
+		t.Fatal("expected a status")
+	}
+	for name, assertion := range map[string][]byte{"Assertion": status.Assertion, "SignedAssertion": status.SignedAssertion} {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromBytes(assertion); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// The namespace of the assertion is declared on the response.
+		root := doc.Root()
+		if root.Tag != "Assertion" || root.NamespaceURI() != "urn:oasis:names:tc:SAML:2.0:assertion" || root.SelectAttrValue("ID", "") != "ASS-1" {
+			t.Errorf("%s: unexpected root %s in namespace %q", name, root.FullTag(), root.NamespaceURI())
+		}
+	}
+	// The signed assertion is unchanged: its attributes are still encrypted.
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(status.SignedAssertion); err != nil {
+		t.Fatal(err)
+	}
+	if doc.FindElement("Assertion/AttributeStatement/EncryptedAttribute/EncryptedData/CipherData/CipherValue") == nil {
+		t.Error("expected the encrypted attribute in SignedAssertion")
+	}
+}
+
+func TestIDINVersionCheck(t *testing.T) {
+	c := &IDINClient{CommonClient: newTestClient("https://example.com/idin")}
+	for _, tc := range []struct {
+		attrs string
+		ok    bool
+	}{
+		{`version="1.0.0" productID="NL:BVN:BankID:1.0"`, true},
+		{`version="3.3.1" productID="NL:BVN:BankID:1.0"`, false},
+		{`version="1.0.0" productID="NL:BVN:eMandatesCore:1.0"`, false},
+		{`version="1.0.0"`, false},
+		{``, false},
+	} {
+		doc := parseTestResponse(t, signResponse(testAcquirerCert, `<DirectoryRes `+tc.attrs+`/>`))
+		if _, err := c.validateMessage(doc, "DirectoryRes"); (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected result %v", tc.attrs, err)
+		}
+	}
+
+	// The check can be skipped for acquirers that send other values.
+	c.SkipVersionCheck = true
+	doc := parseTestResponse(t, signResponse(testAcquirerCert, `<DirectoryRes version="3.3.1"/>`))
+	if _, err := c.validateMessage(doc, "DirectoryRes"); err != nil {
+		t.Errorf("with SkipVersionCheck: expected no error, got %v", err)
+	}
+}
+
+func TestIDINAddress(t *testing.T) {
+	const prefix = "urn:nl:bvn:bankid:1.0:consumer."
+	for _, tc := range []struct {
+		name       string
+		attributes map[string]string
+		address    IDINAddress
+	}{
+		{"complete", map[string]string{
+			prefix + "street":       "Dorpsstraat",
+			prefix + "houseno":      "12",
+			prefix + "housenosuf":   "A",
+			prefix + "addressextra": "t/o",
+			prefix + "postalcode":   "1234AB",
+			prefix + "city":         "Amsterdam",
+			prefix + "country":      "NL",
+		}, IDINAddress{"Dorpsstraat", "12", "A", "t/o", "1234AB", "Amsterdam", "NL"}},
+		{"no addition", map[string]string{
+			prefix + "street":     "Dorpsstraat",
+			prefix + "houseno":    "12",
+			prefix + "postalcode": "1234AB",
+			prefix + "city":       "Amsterdam",
+			prefix + "country":    "NL",
+		}, IDINAddress{Street: "Dorpsstraat", HouseNumber: "12", PostalCode: "1234AB", City: "Amsterdam", Country: "NL"}},
+		{"foreign", map[string]string{
+			prefix + "street":     "Rue de la Loi",
+			prefix + "houseno":    "16",
+			prefix + "postalcode": "1000",
+			prefix + "city":       "Bruxelles",
+			prefix + "country":    "BE",
+		}, IDINAddress{Street: "Rue de la Loi", HouseNumber: "16", PostalCode: "1000", City: "Bruxelles", Country: "BE"}},
+	} {
+		status := &IDINTransactionStatus{Attributes: tc.attributes}
+		if address, ok := status.Address(); !ok || address != tc.address {
+			t.Errorf("%s: expected %+v, got %+v (%v)", tc.name, tc.address, address, ok)
+		}
+	}
+
+	status := &IDINTransactionStatus{Attributes: map[string]string{prefix + "email": "j.jansen@example.com"}}
+	if address, ok := status.Address(); ok {
+		t.Errorf("expected no address, got %+v", address)
+	}
+}
+
+// testIDINStatusResWith returns testIDINStatusRes with the given content of
+// the AttributeStatement.
+func testIDINStatusResWith(statement string) string {
+	start := strings.Index(testIDINStatusRes, "<saml:AttributeStatement>") + len("<saml:AttributeStatement>")
+	end := strings.Index(testIDINStatusRes, "</saml:AttributeStatement>")
+	return testIDINStatusRes[:start] + statement + testIDINStatusRes[end:]
+}
+
+// encryptTestKey encrypts an AES key for cert with RSA-OAEP, as iDIN issuers
+// do, and returns the EncryptedKey element. When id is set, the element gets
+// that Id and a ReferenceList with the given EncryptedData IDs.
+func encryptTestKey(t *testing.T, cert tls.Certificate, key []byte, id string, dataIDs ...string) string {
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, cert.Leaf.PublicKey.(*rsa.PublicKey), key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idAttr, references string
+	if id != "" {
+		idAttr = ` Id="` + id + `"`
+		references = `<xenc:ReferenceList>`
+		for _, dataID := range dataIDs {
+			references += `<xenc:DataReference URI="#` + dataID + `"/>`
+		}
+		references += `</xenc:ReferenceList>`
+	}
+	return `<xenc:EncryptedKey xmlns:xenc="http://www.w3.org/2001/04/xmlenc#"` + idAttr + `>
+  <xenc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"/>
+  <xenc:CipherData><xenc:CipherValue>` + base64.StdEncoding.EncodeToString(encrypted) + `</xenc:CipherValue></xenc:CipherData>
+  ` + references + `
+</xenc:EncryptedKey>`
+}
+
+// testAttribute returns a SAML attribute element with the given name and value.
+func testAttribute(name, value string) string {
+	return `<saml:Attribute xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" Name="` + name + `"><saml:AttributeValue>` + value + `</saml:AttributeValue></saml:Attribute>`
+}
+
+// encryptTestAttribute encrypts a SAML attribute element with AES-128-CBC using
+// key, and returns the EncryptedData element with the given Id and KeyInfo
+// content.
+func encryptTestAttribute(t *testing.T, key []byte, id, keyInfo, attribute string) string {
+	plaintext := []byte(attribute)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := block.BlockSize() - len(plaintext)%block.BlockSize()
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, block.BlockSize()+len(plaintext))
+	if _, err := rand.Read(ciphertext[:block.BlockSize()]); err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(block, ciphertext[:block.BlockSize()]).CryptBlocks(ciphertext[block.BlockSize():], plaintext)
+	if keyInfo != "" {
+		keyInfo = `<ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">` + keyInfo + `</ds:KeyInfo>`
+	}
+	return `<xenc:EncryptedData xmlns:xenc="http://www.w3.org/2001/04/xmlenc#" Id="` + id + `" Type="http://www.w3.org/2001/04/xmlenc#Element">
+  <xenc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes128-cbc"/>
+  ` + keyInfo + `
+  <xenc:CipherData><xenc:CipherValue>` + base64.StdEncoding.EncodeToString(ciphertext) + `</xenc:CipherValue></xenc:CipherData>
+</xenc:EncryptedData>`
+}
+
+func TestStrictDecryption(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	msg := testIDINStatusResWith(`<saml:EncryptedAttribute>` +
+		encryptTestAttribute(t, key, "attr-1", encryptTestKey(t, testMerchantCert, key, ""), testAttribute("urn:nl:bvn:bankid:1.0:consumer.city", "Amsterdam")) +
+		`</saml:EncryptedAttribute>
+<saml:EncryptedAttribute>` +
+		encryptTestAttribute(t, key, "attr-2", encryptTestKey(t, testAcquirerCert, key, ""), testAttribute("urn:nl:bvn:bankid:1.0:consumer.postalcode", "1234AB")) +
+		`</saml:EncryptedAttribute>`)
+	c := &IDINClient{CommonClient: CommonClient{Certificate: testMerchantCert}}
+
+	// By default, the attributes that could be decrypted are returned.
+	status, err := parseTestIDINStatus(t, c, msg)
+	var decryptErr *AttributeDecryptionError
+	if !errors.As(err, &decryptErr) || len(decryptErr.Failures) != 1 || decryptErr.Failures[0].ID != "attr-2" {
+		t.Errorf("expected an AttributeDecryptionError for attr-2, got %v", err)
+	}
+	if status == nil || len(status.Attributes) != 1 || status.Attributes["urn:nl:bvn:bankid:1.0:consumer.city"] != "Amsterdam" {
+		t.Errorf("expected the decrypted attribute, got %+v", status)
+	}
+
+	c.StrictDecryption = true
+	status, err = parseTestIDINStatus(t, c, msg)
+	if err == nil || errors.As(err, &decryptErr) || status != nil {
+		t.Errorf("with StrictDecryption: expected only an error, got %+v, %v", status, err)
+	}
+}
+
+func TestAuthnContextClassRef(t *testing.T) {
+	c := &IDINClient{CommonClient: CommonClient{Certificate: testMerchantCert}}
+	// The attribute in the message can't be decrypted, which doesn't matter
+	// here.
+	status, _ := parseTestIDINStatus(t, c, testIDINStatusRes)
+	if status == nil || status.AuthnContextClassRef != "nl:bvn:bankid:1.0:loa3" || status.AssertionID != "ASS-1" {
+		t.Errorf("expected level of assurance loa3 of assertion ASS-1, got %+v", status)
+	}
+}
+
+// Some banks encrypt all attributes with a single key, which is in a separate
+// EncryptedKey element that refers to the EncryptedData elements it belongs
+// to, or the other way around.
+func TestSharedEncryptedKey(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 16)
+	msg := testIDINStatusResWith(`<saml:EncryptedAttribute>` +
+		encryptTestAttribute(t, key, "attr-1", `<ds:RetrievalMethod URI="#key-1" Type="http://www.w3.org/2001/04/xmlenc#EncryptedKey"/>`, testAttribute("urn:nl:bvn:bankid:1.0:consumer.city", "Amsterdam")) +
+		encryptTestKey(t, testMerchantCert, key, "key-1", "attr-1", "attr-2") +
+		`</saml:EncryptedAttribute>
+<saml:EncryptedAttribute>` +
+		encryptTestAttribute(t, key, "attr-2", "", testAttribute("urn:nl:bvn:bankid:1.0:consumer.postalcode", "1234AB")) +
+		`</saml:EncryptedAttribute>`)
+	c := &IDINClient{CommonClient: CommonClient{Certificate: testMerchantCert}}
+	status, err := parseTestIDINStatus(t, c, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Attributes["urn:nl:bvn:bankid:1.0:consumer.city"] != "Amsterdam" || status.Attributes["urn:nl:bvn:bankid:1.0:consumer.postalcode"] != "1234AB" {
+		t.Errorf("expected both attributes, got %v", status.Attributes)
+	}
+}
+
+func TestRawAttributes(t *testing.T) {
+	key := bytes.Repeat([]byte{5}, 16)
+	const uri = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	msg := testIDINStatusResWith(`<saml:EncryptedAttribute>` +
+		encryptTestAttribute(t, key, "attr-1", encryptTestKey(t, testMerchantCert, key, ""), `<saml:Attribute xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" Name="urn:nl:bvn:bankid:1.0:consumer.dateofbirth" NameFormat="`+uri+`"><saml:AttributeValue xsi:type="xs:string">19700101</saml:AttributeValue></saml:Attribute>`) +
+		`</saml:EncryptedAttribute>
+<saml:EncryptedAttribute>` +
+		encryptTestAttribute(t, key, "attr-2", encryptTestKey(t, testMerchantCert, key, ""), testAttribute("urn:nl:bvn:bankid:1.0:consumer.example", "value")) +
+		`</saml:EncryptedAttribute>`)
+	c := &IDINClient{CommonClient: CommonClient{Certificate: testMerchantCert}}
+	status, err := parseTestIDINStatus(t, c, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []IDINRawAttribute{
+		{Name: "urn:nl:bvn:bankid:1.0:consumer.dateofbirth", NameFormat: uri, Value: "19700101", Type: "xs:string"},
+		{Name: "urn:nl:bvn:bankid:1.0:consumer.example", Value: "value"},
+	}
+	if !reflect.DeepEqual(status.RawAttributes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, status.RawAttributes)
+	}
+	// The flat map has the same attributes.
+	if len(status.Attributes) != 2 || status.Attributes["urn:nl:bvn:bankid:1.0:consumer.example"] != "value" {
+		t.Errorf("unexpected Attributes: %v", status.Attributes)
+	}
+}
+
+func TestSAMLTimestamp(t *testing.T) {
+	if timestamp := samlTimestamp(time.Date(2017, 1, 2, 16, 4, 5, 123456789, time.FixedZone("CET", 3600))); timestamp != "2017-01-02T15:04:05.123Z" {
+		t.Errorf("expected 2017-01-02T15:04:05.123Z, got %s", timestamp)
+	}
+
+	// The IssueInstant is in this format, also with NumericUTCOffset.
+	format := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z$`)
+	c := &IDINClient{CommonClient: newTestClient("https://example.com/idin")}
+	for _, numericUTCOffset := range []bool{false, true} {
+		c.NumericUTCOffset = numericUTCOffset
+		transaction := c.NewTransaction("RABONL2U", "entranceCode", "_1", IDINServiceIDName)
+		issueInstant := transaction.msg.FindElement("Transaction/container/AuthnRequest").SelectAttrValue("IssueInstant", "")
+		if !format.MatchString(issueInstant) {
+			t.Errorf("NumericUTCOffset %v: unexpected IssueInstant %s", numericUTCOffset, issueInstant)
+		}
+	}
+}
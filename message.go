@@ -0,0 +1,48 @@
+package idx
+
+import (
+	"sort"
+
+	"github.com/beevik/etree"
+)
+
+// schemaOrder lists, per element, the order in which its child elements must
+// appear according to the iDeal and iDIN XML schemas. Messages can be built by
+// creating elements in any order: they are put in schema order before signing.
+// Elements that are not listed keep their relative order, after the listed
+// ones.
+var schemaOrder = map[string][]string{
+	"DirectoryReq":      {"createDateTimestamp", "Merchant"},
+	"AcquirerTrxReq":    {"createDateTimestamp", "Issuer", "Merchant", "Transaction"},
+	"AcquirerStatusReq": {"createDateTimestamp", "Merchant", "Transaction"},
+	"Merchant":          {"merchantID", "subID", "merchantReturnURL"},
+	"Transaction":       {"transactionID", "purchaseID", "amount", "currency", "expirationPeriod", "language", "description", "entranceCode", "container"},
+	"AuthnRequest":      {"Issuer", "NameIDPolicy", "RequestedAuthnContext"},
+}
+
+// orderElements sorts the children of el, recursively, in schema order.
+func orderElements(el *etree.Element) {
+	children := el.ChildElements()
+	if order, ok := schemaOrder[el.Tag]; ok {
+		rank := func(child *etree.Element) int {
+			for i, tag := range order {
+				if child.Tag == tag {
+					return i
+				}
+			}
+			return len(order)
+		}
+		sort.SliceStable(children, func(i, j int) bool {
+			return rank(children[i]) < rank(children[j])
+		})
+		for _, child := range children {
+			el.RemoveChild(child)
+		}
+		for _, child := range children {
+			el.AddChild(child)
+		}
+	}
+	for _, child := range children {
+		orderElements(child)
+	}
+}
@@ -0,0 +1,73 @@
+package idx
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// signedTestMessage signs msg with the test signer and parses the result.
+func signedTestMessage(t *testing.T, c *CommonClient, msg *etree.Element) *etree.Element {
+	signed, err := c.signMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(signed); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Root()
+}
+
+// childTags returns the tags of the child elements of el.
+func childTags(el *etree.Element) []string {
+	var tags []string
+	for _, child := range el.ChildElements() {
+		tags = append(tags, child.Tag)
+	}
+	return tags
+}
+
+func TestIDealMessageOrder(t *testing.T) {
+	c := &IDealClient{CommonClient: newTestClient("https://example.com/ideal")}
+	transaction := c.NewTransaction("RABONL2U", "purchase1", "1.00", "description", "entranceCode")
+	// Created after the other elements, but it must come before language.
+	if err := transaction.SetExpirationPeriod(15 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	msg := signedTestMessage(t, &c.CommonClient, transaction.msg)
+	for _, tc := range []struct {
+		el   *etree.Element
+		tags []string
+	}{
+		{msg, []string{"createDateTimestamp", "Issuer", "Merchant", "Transaction", "Signature"}},
+		{msg.SelectElement("Merchant"), []string{"merchantID", "subID", "merchantReturnURL"}},
+		{msg.SelectElement("Transaction"), []string{"purchaseID", "amount", "currency", "expirationPeriod", "language", "description", "entranceCode"}},
+	} {
+		if tags := childTags(tc.el); !reflect.DeepEqual(tags, tc.tags) {
+			t.Errorf("%s: expected %v, got %v", tc.el.Tag, tc.tags, tags)
+		}
+	}
+}
+
+func TestIDINMessageOrder(t *testing.T) {
+	c := &IDINClient{CommonClient: newTestClient("https://example.com/idin")}
+	c.NameIDPolicyFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+	transaction := c.NewTransaction("RABONL2U", "entranceCode", "_1", IDINServiceIDName)
+	msg := signedTestMessage(t, &c.CommonClient, transaction.msg)
+	for _, tc := range []struct {
+		el   *etree.Element
+		tags []string
+	}{
+		{msg, []string{"createDateTimestamp", "Issuer", "Merchant", "Transaction", "Signature"}},
+		{msg.SelectElement("Merchant"), []string{"merchantID", "subID", "merchantReturnURL"}},
+		{msg.SelectElement("Transaction"), []string{"language", "entranceCode", "container"}},
+		{msg.FindElement("Transaction/container/AuthnRequest"), []string{"Issuer", "NameIDPolicy", "RequestedAuthnContext"}},
+	} {
+		if tags := childTags(tc.el); !reflect.DeepEqual(tags, tc.tags) {
+			t.Errorf("%s: expected %v, got %v", tc.el.Tag, tc.tags, tags)
+		}
+	}
+}
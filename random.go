@@ -0,0 +1,59 @@
+package idx
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// randReader returns the source of randomness of the client: Rand, or
+// crypto/rand.Reader when it isn't set.
+func (c *CommonClient) randReader() io.Reader {
+	if c.Rand == nil {
+		return rand.Reader
+	}
+	return c.Rand
+}
+
+// randomString returns a string of n random characters from alphabet, read
+// from r. The alphabet must not be longer than 256 characters.
+func randomString(r io.Reader, n int, alphabet string) (string, error) {
+	// Reject bytes above the largest multiple of len(alphabet), to avoid
+	// biasing towards the first characters of the alphabet.
+	limit := 256 - 256%len(alphabet)
+	result := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(result) < n {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(result) < n {
+				result = append(result, alphabet[int(b)%len(alphabet)])
+			}
+		}
+	}
+	return string(result), nil
+}
+
+// newID returns a random ID read from r that is valid as an xsd:ID.
+func newID(r io.Reader) (string, error) {
+	id, err := randomString(r, 32, "0123456789abcdef")
+	if err != nil {
+		return "", err
+	}
+	// An xsd:ID must not start with a digit.
+	return "_" + id, nil
+}
+
+// NewSAMLID returns a random ID that can be used as the ID of an iDIN SAML
+// request (see IDINClient.NewTransaction). It only fails when Rand fails.
+func (c *CommonClient) NewSAMLID() (string, error) {
+	return newID(c.randReader())
+}
+
+// GenerateEntranceCode returns a random entrance code of the maximum length of
+// 40 characters, using only the letters and digits allowed by
+// ValidateEntranceCode. Like NewSAMLID, it only fails when Rand fails.
+func (c *CommonClient) GenerateEntranceCode() (string, error) {
+	return randomString(c.randReader(), 40, "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+}
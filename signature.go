@@ -0,0 +1,101 @@
+package idx
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/russellhaering/goxmldsig"
+)
+
+// A Signer creates an enveloped XML signature for an outgoing message. It
+// returns the message with the Signature element added, whose KeyInfo must
+// contain a KeyName with the fingerprint of the merchant certificate as
+// required by the iDeal and iDIN specifications.
+//
+// Both specifications only allow enveloped signatures, which is why there is no
+// option for detached or enveloping signatures. An acquirer deviating from this
+// can still be supported with a custom Signer and Verifier, as the returned
+// element is sent as is.
+type Signer interface {
+	Sign(msg *etree.Element) (*etree.Element, error)
+}
+
+// A Verifier validates the XML signature of an incoming message, and returns
+// the signed element. Only the returned element should be trusted.
+type Verifier interface {
+	Verify(msg *etree.Element) (*etree.Element, error)
+}
+
+// defaultSigner signs messages with the certificate of the client using
+// goxmldsig.
+type defaultSigner struct {
+	c *CommonClient
+}
+
+func (s defaultSigner) Sign(msg *etree.Element) (*etree.Element, error) {
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(s.c.Certificate))
+	ctx.Prefix = ""
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(s.c.C14NPrefixList)
+	if s.c.MessageIDAttribute != "" {
+		id, err := newID(s.c.randReader())
+		if err != nil {
+			return nil, err
+		}
+		msg.CreateAttr(s.c.MessageIDAttribute, id)
+		ctx.IdAttribute = s.c.MessageIDAttribute
+	}
+	signed, err := ctx.SignEnveloped(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := signed.FindElement("/Signature/KeyInfo")
+	// remove existing children
+	for _, child := range keyInfo.ChildElements() {
+		keyInfo.RemoveChild(child)
+	}
+	// Insert custom KeyName element
+	keyInfo.CreateElement("KeyName").SetText(keyName(s.c.Certificate.Certificate[0]))
+
+	return signed, nil
+}
+
+// defaultVerifier validates messages against the acquirer certificate of the
+// client using goxmldsig.
+type defaultVerifier struct {
+	c *CommonClient
+}
+
+func (v defaultVerifier) Verify(msg *etree.Element) (*etree.Element, error) {
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{v.c.AcquirerCert},
+	})
+	return ctx.Validate(msg)
+}
+
+// VerifyArchived validates the signature of an archived response against the
+// given acquirer certificate instead of the AcquirerCert of a client. This way
+// old responses can still be verified with the certificate that was valid at
+// the time, after the acquirer certificate has been rotated. It returns the
+// signed element.
+func VerifyArchived(xml []byte, cert *x509.Certificate) (*etree.Element, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(xml); err != nil {
+		return nil, err
+	}
+	if doc.Root() == nil {
+		return nil, errors.New("idx: empty message")
+	}
+	return defaultVerifier{&CommonClient{AcquirerCert: cert}}.Verify(doc.Root())
+}
+
+// keyName returns the KeyName for a certificate as used in iDeal/iDIN
+// signatures: the uppercase hex encoded SHA-1 fingerprint of the certificate.
+func keyName(der []byte) string {
+	fingerprint := sha1.Sum(der)
+	return strings.ToUpper(hex.EncodeToString(fingerprint[:]))
+}
@@ -0,0 +1,46 @@
+package idx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReferenceURI(t *testing.T) {
+	c := &IDealClient{CommonClient: newTestClient("https://example.com/ideal")}
+	c.Signer = nil // use goxmldsig
+
+	msg := signedTestMessage(t, &c.CommonClient, c.createMessage("DirectoryReq"))
+	if uri := msg.FindElement("Signature/SignedInfo/Reference").SelectAttrValue("URI", "-"); uri != "" {
+		t.Errorf("expected an empty Reference URI by default, got %q", uri)
+	}
+
+	c.MessageIDAttribute = "Id"
+	msg = signedTestMessage(t, &c.CommonClient, c.createMessage("DirectoryReq"))
+	id := msg.SelectAttrValue("Id", "")
+	if !strings.HasPrefix(id, "_") {
+		t.Fatalf("expected a random Id attribute on the root, got %q", id)
+	}
+	if uri := msg.FindElement("Signature/SignedInfo/Reference").SelectAttrValue("URI", ""); uri != "#"+id {
+		t.Errorf("expected Reference URI #%s, got %q", id, uri)
+	}
+	if name := msg.FindElement("Signature/KeyInfo/KeyName").Text(); name != keyName(testMerchantCert.Certificate[0]) {
+		t.Errorf("expected the KeyName of the merchant certificate, got %s", name)
+	}
+}
+
+func TestC14NPrefixList(t *testing.T) {
+	c := &IDINClient{CommonClient: newTestClient("https://example.com/idin")}
+	c.Signer = nil // use goxmldsig
+	c.C14NPrefixList = "samlp saml"
+	transaction := c.NewTransaction("RABONL2U", "entranceCode", "_1", IDINServiceIDName)
+	msg := signedTestMessage(t, &c.CommonClient, transaction.msg)
+	found := false
+	for _, el := range msg.FindElements("Signature//InclusiveNamespaces") {
+		if el.SelectAttrValue("PrefixList", "") == "samlp saml" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected the prefix list in the canonicalization transform")
+	}
+}
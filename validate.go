@@ -0,0 +1,85 @@
+package idx
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// isAlphanumeric returns whether s consists of only the ASCII characters
+// a-z, A-Z and 0-9.
+func isAlphanumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateEntranceCode checks whether the entrance code is valid according to
+// the iDeal and iDIN specifications: it must consist of 1 to 40 characters, all
+// of which are ASCII letters or digits.
+func ValidateEntranceCode(entranceCode string) error {
+	if entranceCode == "" {
+		return errors.New("idx: entranceCode is empty")
+	}
+	if len(entranceCode) > 40 {
+		return errors.New("idx: entranceCode is longer than 40 characters")
+	}
+	if !isAlphanumeric(entranceCode) {
+		return errors.New("idx: entranceCode contains characters other than a-z, A-Z and 0-9")
+	}
+	return nil
+}
+
+// NormalizePurchaseID removes surrounding whitespace from a purchase ID and
+// checks it with ValidatePurchaseID. The purchase ID is an opaque string and
+// leading zeros are significant (they appear on the bank statement of the
+// consumer), so "000123" is kept as is. Never store or pass a purchase ID as an
+// integer, as that loses leading zeros.
+func NormalizePurchaseID(purchaseID string) (string, error) {
+	purchaseID = strings.TrimSpace(purchaseID)
+	if err := ValidatePurchaseID(purchaseID); err != nil {
+		return "", err
+	}
+	return purchaseID, nil
+}
+
+// ValidatePurchaseID checks whether the purchase ID is valid according to the
+// iDeal 3.3.1 specification: it must consist of 1 to 35 characters, all of
+// which are ASCII letters or digits. Older iDeal versions allowed only 16
+// characters, which some banks still show on the bank statement.
+func ValidatePurchaseID(purchaseID string) error {
+	if purchaseID == "" {
+		return errors.New("idx: purchaseID is empty")
+	}
+	if len(purchaseID) > 35 {
+		return errors.New("idx: purchaseID is longer than 35 characters")
+	}
+	if !isAlphanumeric(purchaseID) {
+		return errors.New("idx: purchaseID contains characters other than a-z, A-Z and 0-9")
+	}
+	return nil
+}
+
+// ValidateAmount checks whether the amount is valid for an iDeal transaction:
+// it must be positive and have a dot and exactly two decimals, for example
+// "10.00" (see ParseAmount).
+func ValidateAmount(amount string) error {
+	if strings.Contains(amount, ",") {
+		return errors.New("idx: amount " + strconv.Quote(amount) + " contains a comma, use a dot as decimal separator (e.g. \"10.00\")")
+	}
+	if strings.HasPrefix(amount, "-") {
+		return errors.New("idx: amount " + strconv.Quote(amount) + " is negative")
+	}
+	parsed, err := ParseAmount(amount)
+	if err != nil {
+		return err
+	}
+	if parsed == 0 {
+		return errors.New("idx: amount is zero")
+	}
+	return nil
+}
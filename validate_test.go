@@ -0,0 +1,34 @@
+package idx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAmount(t *testing.T) {
+	for _, tc := range []struct {
+		amount string
+		err    string // substring of the error, empty if valid
+	}{
+		{"10.00", ""},
+		{"0.01", ""},
+		{"0.00", "zero"},
+		{"000.00", "zero"},
+		{"-1.00", "negative"},
+		{"-0.00", "negative"},
+		{"10,50", "comma"},
+		{"1,000.00", "comma"},
+		{"10", "idx:"},
+		{"10.5", "idx:"},
+		{"", "idx:"},
+	} {
+		err := ValidateAmount(tc.amount)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("ValidateAmount(%q): unexpected error: %v", tc.amount, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("ValidateAmount(%q): expected an error containing %q, got %v", tc.amount, tc.err, err)
+		}
+	}
+}